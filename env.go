@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// envPrefix is prepended to the upper-cased flag names, with dashes replaced
+// by underscores, to get the environment variables setting them, e.g.
+// TS_AUTH_PROXY_CACHE_SIZE for --cache-size.
+const envPrefix = "TS_AUTH_PROXY_"
+
+// envName returns the environment variable that sets the flag name.
+func envName(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// bindEnv sets the flags that weren't given on the command line from their
+// environment variables, so flags take precedence over the environment,
+// which takes precedence over the defaults.
+func bindEnv(flags *pflag.FlagSet) error {
+	var err error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := flags.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("%s: %v", envName(f.Name), setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestEnvName(t *testing.T) {
+	if got, want := envName("cache-size"), "TS_AUTH_PROXY_CACHE_SIZE"; got != want {
+		t.Errorf("envName = %q, want %q", got, want)
+	}
+}
+
+func TestBindEnv(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	hostname := flags.String("hostname", "ts-auth-proxy", "")
+	cacheSize := flags.Int64("cache-size", 1000, "")
+	listenAddr := flags.String("listen-addr", ":80", "")
+	if err := flags.Parse([]string{"--hostname=flag"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flags take precedence over the environment, which takes precedence
+	// over the defaults
+	t.Setenv("TS_AUTH_PROXY_HOSTNAME", "env")
+	t.Setenv("TS_AUTH_PROXY_CACHE_SIZE", "50")
+	if err := bindEnv(flags); err != nil {
+		t.Fatal(err)
+	}
+	if *hostname != "flag" {
+		t.Errorf("hostname = %q, want the flag value", *hostname)
+	}
+	if *cacheSize != 50 {
+		t.Errorf("cache size = %d, want the environment value", *cacheSize)
+	}
+	if *listenAddr != ":80" {
+		t.Errorf("listen addr = %q, want the default", *listenAddr)
+	}
+
+	// Invalid values name the variable
+	flags = pflag.NewFlagSet("test", pflag.ContinueOnError)
+	flags.Int64("cache-size", 1000, "")
+	t.Setenv("TS_AUTH_PROXY_CACHE_SIZE", "many")
+	if err := bindEnv(flags); err == nil {
+		t.Error("bindEnv accepted an invalid value")
+	}
+}
@@ -1,6 +1,10 @@
 package main
 
 import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/bxnlabs/ts-auth-proxy/server"
@@ -9,23 +13,152 @@ import (
 )
 
 func main() {
-	s := server.Server{}
+	s := server.Server{Config: server.DefaultConfig()}
 
 	rootCmd := &cobra.Command{
 		Use:   "ts-auth-proxy [flags]",
 		Short: "A lightweight Tailscale authentication server.",
+		Long: `A lightweight Tailscale authentication server.
+
+Every flag can also be set with an environment variable named after it,
+prefixed with TS_AUTH_PROXY_, e.g. TS_AUTH_PROXY_CACHE_SIZE for --cache-size.
+Flags given on the command line take precedence over the environment.`,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			return bindEnv(cmd.Flags())
+		},
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := s.Run(); err != nil {
+			if err := s.Run(cmd.Context()); err != nil {
 				cmd.PrintErrln("Error:", err)
 			}
 		},
 	}
-	rootCmd.Flags().Int64VarP(&s.CacheSize, "cache-size", "s", 1000, "Maximum number of entries in the cache")
-	rootCmd.Flags().DurationVarP(&s.CacheExpiry, "cache-expiry", "e", 10*time.Minute, "Time after which cache entries expire")
-	rootCmd.Flags().StringVarP(&s.ControlURL, "control-url", "c", ipn.DefaultControlURL, "URL for Tailscale control server")
-	rootCmd.Flags().StringVarP(&s.Hostname, "hostname", "H", "auth-server", "Hostname for proxy on Tailnet")
-	rootCmd.Flags().StringVarP(&s.StateDir, "state-dir", "d", "/var/run/ts-auth-proxy", "Directory to store state in")
-	rootCmd.Flags().StringVarP(&s.TrustedCIDR, "trusted-cidr", "t", "10.42.0.0/16", "Comma-separated string of trusted CIDR ranges")
-
-	_ = rootCmd.Execute()
+	validateCmd := &cobra.Command{
+		Use:   "validate [flags]",
+		Short: "Validate the configuration and tailnet connectivity without serving traffic.",
+		// Only print usage for flag errors, not failed validation
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return s.Validate(cmd.Context())
+		},
+	}
+	var statusFormat string
+	statusCmd := &cobra.Command{
+		Use:          "status [flags]",
+		Short:        "Print the proxy node's tailnet status without serving traffic.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return s.Status(cmd.Context(), cmd.OutOrStdout(), statusFormat)
+		},
+	}
+	statusCmd.Flags().StringVarP(&statusFormat, "output", "o", "table", "Output format (table, json)")
+	systemdCmd := &cobra.Command{
+		Use:          "systemd [flags]",
+		Short:        "Print a systemd unit that runs the proxy with the given flags.",
+		SilenceUsage: true,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			exe, err := os.Executable()
+			if err != nil {
+				return err
+			}
+			return writeSystemdUnit(cmd.OutOrStdout(), exe, cmd.Flags(), s.StateDir)
+		},
+	}
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Print the version and build details.",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return writeVersion(cmd.OutOrStdout())
+		},
+	}
+	rootCmd.AddCommand(validateCmd, statusCmd, systemdCmd, versionCmd)
+	rootCmd.Version = readBuildInfo().String()
+	rootCmd.SetVersionTemplate("{{ .Version }}\n")
+
+	flags := rootCmd.PersistentFlags()
+	flags.BoolVar(&s.AccessLog, "access-log", s.AccessLog, "Log a line for every forward-auth request")
+	flags.StringVar(&s.AdvertiseTags, "advertise-tags", "", "Comma-separated list of tags (e.g. tag:auth-proxy) for the proxy node to advertise, required by auth keys for tagged nodes")
+	flags.BoolVar(&s.AllowInsecureIdentity, "allow-insecure-identity", false, "Send identity headers even when the scheme header says the original request was plain HTTP")
+	flags.BoolVar(&s.AllowQueryToken, "allow-query-token", false, "Accept --query-token in a ts_token query parameter of the original request, for clients that can't set headers (e.g. EventSource); the gateway should forward the Tailscale-Forward-Uri response header, which has the parameter removed, as the request URI. Requires --trusted-proxies")
+	flags.StringArrayVar(&s.AllowedLoginsRegex, "allowed-logins-regex", nil, "Regular expression resolved logins must match to be authorized, may be repeated")
+	flags.StringVar(&s.AuthKey, "auth-key", "", "Tailscale auth key used to join the tailnet (defaults to $TS_AUTHKEY)")
+	flags.StringVar(&s.BasicAuthFile, "basic-auth-file", "", "htpasswd file of login:bcrypt-hash lines checked by the basicauth identity source")
+	flags.StringVar(&s.BypassLogin, "bypass-login", s.BypassLogin, "Login reported for requests authorized with the bypass token")
+	flags.StringVar(&s.BypassToken, "bypass-token", "", "Bearer token that authorizes machine-to-machine clients without WhoIs (disabled if empty)")
+	flags.StringVar(&s.CacheBackend, "cache-backend", "memory", "Where cached profiles are kept: in memory only, also saved to --cache-file periodically and on shutdown and loaded on startup, or in Redis at --redis-url shared between replicas (memory, file, redis)")
+	flags.StringVar(&s.CacheCostMode, "cache-cost-mode", s.CacheCostMode, "How cache size is measured: count of entries or bytes of serialized profiles (count, bytes)")
+	flags.StringVar(&s.CacheKey, "cache-key", s.CacheKey, "What profiles are cached by: each address, or each login so a user's devices share their user details (address, login)")
+	flags.Int64VarP(&s.CacheSize, "cache-size", "s", s.CacheSize, "Maximum number of entries in the cache, or bytes with --cache-cost-mode=bytes")
+	flags.DurationVarP(&s.CacheExpiry, "cache-expiry", "e", s.CacheExpiry, "Time after which cache entries expire (never if 0, entries then stay until evicted or purged through the admin API)")
+	flags.Float64Var(&s.CacheExpiryJitter, "cache-expiry-jitter", 0, "Fraction by which to randomly vary each cache entry's expiry, up to 0.5, e.g. 0.1 for +/-10%")
+	flags.StringVar(&s.CacheFile, "cache-file", "", "Path of the cache file for --cache-backend=file (defaults to profiles.json in the state directory)")
+	flags.DurationVar(&s.CacheSaveInterval, "cache-save-interval", time.Minute, "How often the cache is saved to --cache-file with --cache-backend=file, besides on shutdown (only on shutdown if 0)")
+	flags.StringVar(&s.CIDRPolicy, "cidr-policy", "", "Comma-separated list of allow:CIDR and deny:CIDR rules; allowed ranges are trusted like --trusted-cidr, denied ranges are rejected with 403 even if trusted")
+	flags.StringVar(&s.Compat, "compat", "", "Also set the identity headers and success status a gateway expects (traefik, nginx, oauth2-proxy)")
+	flags.StringVarP(&s.ControlURL, "control-url", "c", ipn.DefaultControlURL, "URL for Tailscale control server")
+	flags.BoolVar(&s.DeepHealthcheck, "deep-healthcheck", false, "Fail /readyz unless a WhoIs lookup of the proxy's own address succeeds")
+	flags.StringVar(&s.DefaultPolicy, "default-policy", s.DefaultPolicy, "Whether to allow or deny identified clients that no rule (trusted tags, route policy, login allowlist or required capability) explicitly allows")
+	flags.DurationVar(&s.DenialCacheTTL, "denial-cache-ttl", 0, "Time for which denied requests for the same address and path are rejected without re-checking (disabled if 0)")
+	flags.BoolVar(&s.DeviceHeaders, "device-headers", false, "Forward the node's OS and device model in the Tailscale-Device-OS and Tailscale-Device-Model headers")
+	flags.BoolVar(&s.EchoRemoteAddr, "echo-remote-addr", false, "Echo the client address and port used for identity lookups in Tailscale-Resolved-Addr and Tailscale-Resolved-Port response headers")
+	flags.BoolVar(&s.Ephemeral, "ephemeral", false, "Register as an ephemeral node that is removed from the tailnet on shutdown")
+	flags.BoolVar(&s.ExposeTimingHeader, "expose-timing-header", false, "Report time spent handling each request in the X-Proxy-Time-Ms response header")
+	flags.BoolVar(&s.ForwardWhoIsJSON, "forward-whois-json", false, "Forward node info and capabilities from WhoIs as base64 JSON in the Tailscale-Whois header")
+	flags.StringVar(&s.HeaderSigningKey, "header-signing-key", "", "Shared secret used to HMAC-sign identity headers (disabled if empty)")
+	flags.StringVarP(&s.Hostname, "hostname", "H", "auth-server", "Hostname for proxy on Tailnet")
+	flags.StringVar(&s.IdentityHeader, "identity-header", s.IdentityHeader, "Header holding the login for the header identity source, only trusted from --trusted-proxies")
+	flags.StringVar(&s.IdentitySources, "identity-sources", s.IdentitySources, "Comma-separated list of identity sources to try in order (token, header, basicauth, whois)")
+	flags.DurationVar(&s.IdleTimeout, "idle-timeout", 0, "Time to keep idle keep-alive connections open (read timeout if 0)")
+	flags.BoolVar(&s.JSONErrors, "json-errors", false, "Describe authorization failures in a JSON body with a machine-readable error code to clients accepting JSON")
+	flags.StringVar(&s.LatencyBuckets, "latency-buckets", s.LatencyBuckets, "Comma-separated upper bounds in seconds of the WhoIs latency histogram buckets")
+	flags.StringVar(&s.ListenAddr, "listen-addr", ":80", "Address to serve forward-auth requests on")
+	flags.StringVar(&s.ListenFamily, "listen-family", "both", "IP family to listen on (both, ipv4, ipv6)")
+	flags.StringVar(&s.AccessLogFormat, "log-format", s.AccessLogFormat, "Format of access log lines: text, clf (Combined Log Format) or clf-extended (login in a trailing field)")
+	flags.StringVar(&s.LogLevel, "log-level", "info", "Minimum level of messages to log (debug, info, warn, error)")
+	flags.StringVar(&s.LogTimeFormat, "log-time-format", "rfc3339", "Format of log timestamps: clf, rfc3339 or a Go time layout")
+	flags.BoolVar(&s.LoginHintPage, "login-hint-page", false, "Explain how to join the tailnet to unidentified browsers instead of a bare 401")
+	flags.IntVar(&s.MaxConcurrent, "max-concurrent", 0, "Maximum number of forward-auth requests handled at once, further requests are rejected with 503 (no limit if 0)")
+	flags.IntVar(&s.MaxHeaderBytes, "max-header-bytes", 0, "Maximum size of request headers in bytes (1 MiB if 0)")
+	flags.StringVar(&s.MetricsAddr, "metrics-addr", "", "Address to serve metrics, health checks and cache admin endpoints on, bound to localhost if no host is given (disabled if empty)")
+	flags.StringVar(&s.MinHTTPVersion, "min-http-version", s.MinHTTPVersion, "Minimum HTTP version to accept, older requests are rejected with 505")
+	flags.StringVar(&s.NameFallback, "name-fallback", "", "Name to use for users without a display name: the whole login or its part before the @ (login, login-local)")
+	flags.StringVar(&s.OTelEndpoint, "otel-endpoint", "", "OTLP/HTTP collector URL (e.g. http://localhost:4318) to export request and WhoIs spans to (disabled if empty)")
+	flags.StringVar(&s.PolicyFile, "policy-file", "", "JSON file of authorization rules (e.g. allowed_logins_regex, trusted_cidr, compat) overriding their flags, re-read on SIGHUP. Rules left out of the file fall back to their flags; other settings, like --identity-header and --scheme-header, are only read on startup")
+	flags.StringVar(&s.PprofAddr, "pprof-addr", "", "Address to serve pprof endpoints on, bound to localhost if no host is given (disabled if empty)")
+	flags.BoolVar(&s.ProxyProtocol, "proxy-protocol", false, "Expect a PROXY protocol v1/v2 header on forward-auth connections and use its client address")
+	flags.StringVar(&s.QueryToken, "query-token", "", "Token accepted in a ts_token query parameter with --allow-query-token, separate from the bypass token")
+	flags.StringVar(&s.QueryTokenHosts, "query-token-hosts", "", "Comma-separated list of hosts the query token is accepted for, required with --allow-query-token")
+	flags.Float64Var(&s.RateLimit, "rate-limit", 0, "Maximum requests per second per user (disabled if 0)")
+	flags.IntVar(&s.RateBurst, "rate-burst", s.RateBurst, "Maximum burst of requests per user when rate limiting")
+	flags.DurationVar(&s.ReadHeaderTimeout, "read-header-timeout", 10*time.Second, "Time allowed to read request headers (no limit if 0)")
+	flags.DurationVar(&s.ReadTimeout, "read-timeout", 0, "Time allowed to read a whole request (no limit if 0)")
+	flags.StringVar(&s.RedisURL, "redis-url", "", "URL of the Redis server for --cache-backend=redis, e.g. redis://localhost:6379/0; WhoIs is used when it can't be reached")
+	flags.BoolVar(&s.RejectInvalidHeaders, "reject-invalid-headers", false, "Reject requests with control characters (CR, LF, NUL) in header values with 400")
+	flags.StringVar(&s.RequiredCap, "required-cap", "", "Capability that must be granted to a node via ACL grants to be authorized")
+	flags.BoolVar(&s.ResponseBody, "response-body", false, "Also write the resolved identity, or an error code, as a JSON response body")
+	flags.StringArrayVar(&s.RoutePolicies, "route-policy", nil, "Restrict a host to logins and tags, as host=login,tag:name,... (may be repeated). The host is only trusted from --trusted-proxies")
+	flags.StringVar(&s.SchemeHeader, "scheme-header", s.SchemeHeader, "Header in which the gateway gives the scheme of the original request, only honored from --trusted-proxies when set")
+	flags.DurationVar(&s.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "Time to wait for in-flight requests to drain on shutdown")
+	flags.DurationVar(&s.StaleWhileRevalidate, "stale-while-revalidate", 0, "Time after expiry during which a cached profile is still served while it's refreshed in the background")
+	flags.DurationVar(&s.StartupTimeout, "startup-timeout", 5*time.Minute, "Time to wait for Tailscale to reach the running state on startup (no limit if 0)")
+	flags.StringVarP(&s.StateDir, "state-dir", "d", "/var/run/ts-auth-proxy", "Directory to store state in")
+	flags.IntVar(&s.SuccessStatus, "success-status", 0, "Status code written for authorized requests, must be 2xx (200, or the --compat preset's, if 0)")
+	flags.StringVar(&s.TaggedNodePolicy, "tagged-node-policy", s.TaggedNodePolicy, "How tagged nodes are handled: rejected, identified by their tags as the login, or let through without identity if they have a --trusted-tags or route policy tag (forbid, allow, allow-specific)")
+	flags.StringVarP(&s.TrustedCIDR, "trusted-cidr", "t", s.TrustedCIDR, "Comma-separated string of trusted CIDR ranges")
+	flags.StringVar(&s.TrustedIdentity, "trusted-identity", "", "Synthetic identity reported for trusted CIDR requests, as login[,name] (no identity headers if empty)")
+	flags.StringVar(&s.TrustedProxies, "trusted-proxies", "", "Comma-separated string of CIDR ranges of proxies allowed to forward client addresses")
+	flags.StringVar(&s.TrustedTags, "trusted-tags", "", "Comma-separated list of node tags (e.g. tag:monitoring) allowed through without a user identity, except on hosts with a --route-policy")
+	flags.BoolVar(&s.TSVerbose, "ts-verbose", false, "Log tsnet's backend messages at info rather than debug level")
+	flags.IntVar(&s.WhoIsRetries, "whois-retries", s.WhoIsRetries, "Number of times to retry WhoIs lookups that fail with a transient error")
+	flags.DurationVar(&s.WhoIsTimeout, "whois-timeout", 0, "Time allowed for a WhoIs lookup including retries (30s if 0)")
+	flags.DurationVar(&s.WriteTimeout, "write-timeout", 0, "Time allowed to write a response (no limit if 0)")
+
+	// Shut down gracefully when asked to stop
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := rootCmd.ExecuteContext(ctx); err != nil {
+		stop()
+		os.Exit(1)
+	}
 }
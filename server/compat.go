@@ -0,0 +1,47 @@
+package server
+
+import "net/http"
+
+// compatPreset adapts responses to the conventions of a particular gateway.
+type compatPreset struct {
+	// loginHeaders and nameHeaders are additional headers carrying the
+	// login and display name, alongside the Tailscale-User-* headers.
+	loginHeaders []string
+	nameHeaders  []string
+	// successStatus is the status written for authorized requests.
+	successStatus int
+}
+
+// compatPresets maps the --compat preset names to their settings.
+var compatPresets = map[string]*compatPreset{
+	// Traefik's forwardAuth is usually configured to copy X-Forwarded-User
+	// through authResponseHeaders
+	"traefik": {
+		loginHeaders:  []string{"X-Forwarded-User"},
+		successStatus: http.StatusOK,
+	},
+	// nginx's auth_request only treats 2xx, 401 and 403 specially, and
+	// headers are picked up with auth_request_set $upstream_http_x_user
+	"nginx": {
+		loginHeaders:  []string{"X-User", "X-Email"},
+		nameHeaders:   []string{"X-Name"},
+		successStatus: http.StatusOK,
+	},
+	// Matches oauth2-proxy's /oauth2/auth endpoint, so gateway configs
+	// written for it work unchanged
+	"oauth2-proxy": {
+		loginHeaders:  []string{"X-Auth-Request-User", "X-Auth-Request-Email"},
+		nameHeaders:   []string{"X-Auth-Request-Preferred-Username"},
+		successStatus: http.StatusAccepted,
+	},
+}
+
+// setHeaders sets the preset's identity headers for profile.
+func (cp *compatPreset) setHeaders(h http.Header, profile *userProfile) {
+	for _, name := range cp.loginHeaders {
+		h.Set(name, profile.Login)
+	}
+	for _, name := range cp.nameHeaders {
+		h.Set(name, profile.Name)
+	}
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"maps"
+	"net/http"
+	"testing"
+)
+
+func TestCompatPresetHeaders(t *testing.T) {
+	profile := &userProfile{Login: "alice@example.com", Name: "Alice"}
+	tests := []struct {
+		preset     string
+		want       http.Header
+		wantStatus int
+	}{
+		{
+			preset:     "traefik",
+			want:       http.Header{"X-Forwarded-User": {"alice@example.com"}},
+			wantStatus: http.StatusOK,
+		},
+		{
+			preset: "nginx",
+			want: http.Header{
+				"X-User":  {"alice@example.com"},
+				"X-Email": {"alice@example.com"},
+				"X-Name":  {"Alice"},
+			},
+			wantStatus: http.StatusOK,
+		},
+		{
+			preset: "oauth2-proxy",
+			want: http.Header{
+				"X-Auth-Request-User":               {"alice@example.com"},
+				"X-Auth-Request-Email":              {"alice@example.com"},
+				"X-Auth-Request-Preferred-Username": {"Alice"},
+			},
+			wantStatus: http.StatusAccepted,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.preset, func(t *testing.T) {
+			cp := compatPresets[tt.preset]
+			h := http.Header{}
+			cp.setHeaders(h, profile)
+			if !maps.EqualFunc(h, tt.want, func(a, b []string) bool { return len(a) == 1 && len(b) == 1 && a[0] == b[0] }) {
+				t.Errorf("headers = %v, want %v", h, tt.want)
+			}
+			if cp.successStatus != tt.wantStatus {
+				t.Errorf("success status = %d, want %d", cp.successStatus, tt.wantStatus)
+			}
+		})
+	}
+}
@@ -0,0 +1,663 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tailscale.com/client/local"
+)
+
+// Config holds the settings of the forward-auth handler.
+type Config struct {
+	Policy
+
+	AccessLog             bool          `json:"access_log"`
+	AccessLogFormat       string        `json:"log_format"`
+	AllowInsecureIdentity bool          `json:"allow_insecure_identity"`
+	AllowQueryToken       bool          `json:"allow_query_token"`
+	BasicAuthFile         string        `json:"basic_auth_file"`
+	BypassLogin           string        `json:"bypass_login"`
+	BypassToken           string        `json:"bypass_token"`
+	CacheCostMode         string        `json:"cache_cost_mode"`
+	CacheExpiry           time.Duration `json:"cache_expiry"`
+	CacheExpiryJitter     float64       `json:"cache_expiry_jitter"`
+	CacheKey              string        `json:"cache_key"`
+	CacheSize             int64         `json:"cache_size"`
+	DenialCacheTTL        time.Duration `json:"denial_cache_ttl"`
+	DeviceHeaders         bool          `json:"device_headers"`
+	EchoRemoteAddr        bool          `json:"echo_remote_addr"`
+	ExposeTimingHeader    bool          `json:"expose_timing_header"`
+	ForwardWhoIsJSON      bool          `json:"forward_whois_json"`
+	HeaderSigningKey      string        `json:"header_signing_key"`
+	IdentityHeader        string        `json:"identity_header"`
+	IdentitySources       string        `json:"identity_sources"`
+	JSONErrors            bool          `json:"json_errors"`
+	LatencyBuckets        string        `json:"latency_buckets"`
+	LoginHintPage         bool          `json:"login_hint_page"`
+	MaxConcurrent         int           `json:"max_concurrent"`
+	MinHTTPVersion        string        `json:"min_http_version"`
+	NameFallback          string        `json:"name_fallback"`
+	ProxyProtocol         bool          `json:"proxy_protocol"`
+	QueryToken            string        `json:"query_token"`
+	QueryTokenHosts       string        `json:"query_token_hosts"`
+	RateBurst             int           `json:"rate_burst"`
+	RateLimit             float64       `json:"rate_limit"`
+	RejectInvalidHeaders  bool          `json:"reject_invalid_headers"`
+	ResponseBody          bool          `json:"response_body"`
+	SchemeHeader          string        `json:"scheme_header"`
+	StaleWhileRevalidate  time.Duration `json:"stale_while_revalidate"`
+	TrustedProxies        string        `json:"trusted_proxies"`
+	WhoIsRetries          int           `json:"whois_retries"`
+	WhoIsTimeout          time.Duration `json:"whois_timeout"`
+}
+
+// Policy holds the authorization rules of the forward-auth handler, which
+// can be reloaded from a policy file while running.
+type Policy struct {
+	AllowedLoginsRegex []string `json:"allowed_logins_regex"`
+	CIDRPolicy         string   `json:"cidr_policy"`
+	Compat             string   `json:"compat"`
+	DefaultPolicy      string   `json:"default_policy"`
+	RequiredCap        string   `json:"required_cap"`
+	RoutePolicies      []string `json:"route_policies"`
+	SuccessStatus      int      `json:"success_status"`
+	TaggedNodePolicy   string   `json:"tagged_node_policy"`
+	TrustedCIDR        string   `json:"trusted_cidr"`
+	TrustedIdentity    string   `json:"trusted_identity"`
+	TrustedTags        string   `json:"trusted_tags"`
+}
+
+// config holds the parsed form of the settings.
+type config struct {
+	allowedLogins    []*regexp.Regexp
+	compat           *compatPreset
+	defaultPolicy    string
+	deniedCIDRs      []netip.Prefix
+	identitySources  []string
+	queryTokenHosts  []string
+	latencyBuckets   []float64
+	routePolicies    map[string]*routePolicy
+	trustedCIDRs     []netip.Prefix
+	trustedIdentity  *userProfile
+	trustedProxies   []netip.Prefix
+	trustedTags      []string
+	logLevel         slog.Level
+	network          string
+	redisURL         string
+	minMajor         int
+	minMinor         int
+	successStatus    int
+	requiredCap      string
+	taggedNodePolicy string
+}
+
+func (c *Config) parse() (*config, error) {
+	var cfg config
+	var err error
+
+	// Compile the login allowlist patterns
+	for _, pattern := range c.AllowedLoginsRegex {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed logins regex: %v", err)
+		}
+		cfg.allowedLogins = append(cfg.allowedLogins, re)
+	}
+
+	// Check the access log format
+	if !slices.Contains(accessLogFormats, c.AccessLogFormat) {
+		return nil, fmt.Errorf("invalid access log format: %s", c.AccessLogFormat)
+	}
+
+	// Check the cache cost mode
+	if c.CacheCostMode != cacheCostModeCount && c.CacheCostMode != cacheCostModeBytes {
+		return nil, fmt.Errorf("invalid cache cost mode: %s", c.CacheCostMode)
+	}
+
+	// Check what the cache is keyed by
+	if !slices.Contains(cacheKeys, c.CacheKey) {
+		return nil, fmt.Errorf("invalid cache key: %s", c.CacheKey)
+	}
+
+	// Check the cache expiry, zero meaning entries don't expire
+	if c.CacheExpiry < 0 {
+		return nil, fmt.Errorf("cache expiry must not be negative: %v", c.CacheExpiry)
+	}
+
+	// Check the rate limit burst, as a limiter without one rejects every
+	// request
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		return nil, fmt.Errorf("rate burst must be at least 1 when rate limiting: %d", c.RateBurst)
+	}
+
+	// Check the cache expiry jitter. Past half the expiry, jittered entries
+	// could expire almost as soon as they're set.
+	if c.CacheExpiryJitter < 0 || c.CacheExpiryJitter > maxCacheExpiryJitter {
+		return nil, fmt.Errorf("cache expiry jitter must be between 0 and %v: %v", maxCacheExpiryJitter, c.CacheExpiryJitter)
+	}
+
+	// Check the name fallback
+	if !slices.Contains(nameFallbacks, c.NameFallback) {
+		return nil, fmt.Errorf("invalid name fallback: %s", c.NameFallback)
+	}
+
+	// Parse the latency histogram buckets
+	if cfg.latencyBuckets, err = parseBuckets(c.LatencyBuckets); err != nil {
+		return nil, fmt.Errorf("invalid latency buckets: %v", err)
+	}
+
+	// Parse the identity resolution chain
+	for _, name := range strings.Split(c.IdentitySources, ",") {
+		name = strings.TrimSpace(name)
+		if name == "clientcert" {
+			// The proxy doesn't terminate TLS, so it never sees a client
+			// certificate to resolve
+			return nil, errors.New("the clientcert identity source isn't supported")
+		}
+		if !slices.Contains(identitySources, name) {
+			return nil, fmt.Errorf("unknown identity source: %s", name)
+		}
+		cfg.identitySources = append(cfg.identitySources, name)
+	}
+	if slices.Contains(cfg.identitySources, "basicauth") && c.BasicAuthFile == "" {
+		return nil, errors.New("the basicauth identity source requires a basic auth file")
+	}
+	if slices.Contains(cfg.identitySources, "header") && (c.IdentityHeader == "" || c.TrustedProxies == "") {
+		return nil, errors.New("the header identity source requires an identity header and trusted proxies")
+	}
+
+	// The query token ends up in URLs, so it's kept apart from the bypass
+	// token and limited to the hosts that need it
+	for _, host := range strings.Split(c.QueryTokenHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			cfg.queryTokenHosts = append(cfg.queryTokenHosts, normalizeHost(host))
+		}
+	}
+	if c.AllowQueryToken {
+		if c.QueryToken == "" || len(cfg.queryTokenHosts) == 0 {
+			return nil, errors.New("allowing query tokens requires a query token and query token hosts")
+		}
+		if c.TrustedProxies == "" {
+			return nil, errors.New("allowing query tokens requires trusted proxies to report the forwarded host")
+		}
+		if c.QueryToken == c.BypassToken {
+			return nil, errors.New("the query token must differ from the bypass token")
+		}
+	} else if c.QueryToken != "" {
+		return nil, errors.New("the query token is only accepted when query tokens are allowed")
+	}
+
+	// Parse the trusted CIDR ranges
+	if cfg.trustedCIDRs, err = parsePrefixes(c.TrustedCIDR); err != nil {
+		return nil, fmt.Errorf("invalid trusted CIDR: %v", err)
+	}
+
+	// Parse the CIDR policy. Its allowed ranges are trusted like the
+	// trusted CIDR ranges.
+	allowedCIDRs, deniedCIDRs, err := parseCIDRPolicy(c.CIDRPolicy)
+	if err != nil {
+		return nil, err
+	}
+	cfg.trustedCIDRs = append(cfg.trustedCIDRs, allowedCIDRs...)
+	cfg.deniedCIDRs = deniedCIDRs
+
+	// Parse the identity reported for trusted CIDR requests
+	if c.TrustedIdentity != "" {
+		login, name, _ := strings.Cut(c.TrustedIdentity, ",")
+		if login = strings.TrimSpace(login); login == "" {
+			return nil, fmt.Errorf("invalid trusted identity: %s", c.TrustedIdentity)
+		}
+		if name = strings.TrimSpace(name); name == "" {
+			name = login
+		}
+		cfg.trustedIdentity = &userProfile{Login: login, Name: name}
+	}
+
+	// Parse the trusted proxy ranges
+	if cfg.trustedProxies, err = parsePrefixes(c.TrustedProxies); err != nil {
+		return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+	}
+
+	// Parse the per-route policies
+	if cfg.routePolicies, err = parseRoutePolicies(c.RoutePolicies); err != nil {
+		return nil, err
+	}
+	if len(cfg.routePolicies) > 0 && len(cfg.trustedProxies) == 0 {
+		return nil, errors.New("route policies require trusted proxies to report the forwarded host")
+	}
+
+	// Check the tagged node policy
+	if !slices.Contains(taggedNodePolicies, c.TaggedNodePolicy) {
+		return nil, fmt.Errorf("invalid tagged node policy: %s", c.TaggedNodePolicy)
+	}
+	cfg.taggedNodePolicy = c.TaggedNodePolicy
+
+	// Check the default policy
+	if !slices.Contains(defaultPolicies, c.DefaultPolicy) {
+		return nil, fmt.Errorf("invalid default policy: %s", c.DefaultPolicy)
+	}
+	cfg.defaultPolicy = c.DefaultPolicy
+	cfg.requiredCap = c.RequiredCap
+
+	// Parse the trusted tags
+	for _, tag := range strings.Split(c.TrustedTags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			cfg.trustedTags = append(cfg.trustedTags, tag)
+		}
+	}
+
+	// Look up the gateway compatibility preset
+	var ok bool
+	cfg.successStatus = http.StatusOK
+	if c.Compat != "" {
+		if cfg.compat, ok = compatPresets[c.Compat]; !ok {
+			return nil, fmt.Errorf("invalid compat preset: %s", c.Compat)
+		}
+		cfg.successStatus = cfg.compat.successStatus
+	}
+
+	// Check the success status, which overrides the preset's
+	if c.SuccessStatus != 0 {
+		if c.SuccessStatus < 200 || c.SuccessStatus > 299 {
+			return nil, fmt.Errorf("success status must be 2xx: %d", c.SuccessStatus)
+		}
+		cfg.successStatus = c.SuccessStatus
+	}
+
+	// Parse the minimum accepted HTTP version
+	cfg.minMajor, cfg.minMinor, ok = http.ParseHTTPVersion("HTTP/" + c.MinHTTPVersion)
+	if !ok {
+		return nil, fmt.Errorf("invalid minimum HTTP version: %s", c.MinHTTPVersion)
+	}
+
+	return &cfg, nil
+}
+
+// DefaultConfig returns the settings the ts-auth-proxy command starts from
+// before its flags are applied. Settings left at their zero value aren't
+// valid on their own, so embedders should start from these.
+func DefaultConfig() Config {
+	return Config{
+		Policy: Policy{
+			DefaultPolicy:    defaultPolicyAllow,
+			TaggedNodePolicy: taggedNodeAllowSpecific,
+			TrustedCIDR:      "10.42.0.0/16",
+		},
+		AccessLog:       true,
+		AccessLogFormat: accessLogFormatText,
+		BypassLogin:     "machine",
+		CacheCostMode:   cacheCostModeCount,
+		CacheExpiry:     10 * time.Minute,
+		CacheKey:        cacheKeyAddress,
+		CacheSize:       1000,
+		IdentityHeader:  "X-Forwarded-User",
+		IdentitySources: "token,whois",
+		LatencyBuckets:  "0.005,0.01,0.025,0.05,0.1,0.25,0.5,1,2.5,5,10",
+		MinHTTPVersion:  "1.0",
+		RateBurst:       10,
+		SchemeHeader:    "X-Forwarded-Proto",
+		WhoIsRetries:    1,
+	}
+}
+
+// NewAuthHandler returns the forward-auth handler for cfg, resolving
+// identities with whois. This allows the handler to be embedded in another
+// server which owns the tailnet connection. cfg should start from
+// DefaultConfig.
+func NewAuthHandler(cfg Config, whois WhoIser) (http.Handler, error) {
+	parsed, err := cfg.parse()
+	if err != nil {
+		return nil, err
+	}
+	ah, err := newAuthHandler(&cfg, parsed, whois)
+	if err != nil {
+		return nil, err
+	}
+	return ah.handler(), nil
+}
+
+// authHandler authorizes forward-auth requests.
+type authHandler struct {
+	*Config
+	// cfg is swapped when the policy is reloaded, along with settings, the
+	// effective settings with the policy file applied
+	cfg      atomic.Pointer[config]
+	settings atomic.Pointer[Config]
+	cache    *cache
+	// profiles is where resolved profiles are cached: the in-memory cache,
+	// or Redis when it's shared between replicas
+	profiles  profileCache
+	denials   *denialCache
+	limiter   *rateLimiter
+	resolvers []resolver
+
+	// whoisLatency records how long WhoIs lookups take
+	whoisLatency *histogram
+}
+
+func newAuthHandler(c *Config, cfg *config, whois WhoIser) (*authHandler, error) {
+	ah := &authHandler{Config: c}
+	ah.cfg.Store(cfg)
+	ah.settings.Store(c)
+
+	// Initialize the in-memory cache
+	var err error
+	if ah.cache, err = newCache(c.CacheSize, c.CacheCostMode, c.CacheExpiryJitter, c.StaleWhileRevalidate); err != nil {
+		return nil, fmt.Errorf("failed to create cache: %v", err)
+	}
+	ah.profiles = ah.cache
+	if cfg.redisURL != "" {
+		if ah.profiles, err = newRedisCache(cfg.redisURL, c.CacheExpiryJitter, c.StaleWhileRevalidate); err != nil {
+			return nil, err
+		}
+	}
+
+	// Initialize the denial cache. Denials are only remembered for a short
+	// window so a change in identity or permissions is picked up promptly.
+	// It holds as many entries as the profile cache, whatever its cost mode.
+	if c.DenialCacheTTL > 0 {
+		if ah.denials, err = newDenialCache(cacheEntries(c.CacheSize, c.CacheCostMode)); err != nil {
+			return nil, fmt.Errorf("failed to create denial cache: %v", err)
+		}
+	}
+
+	// Initialize the per-user rate limiter
+	if c.RateLimit > 0 {
+		ah.limiter = newRateLimiter(c.RateLimit, c.RateBurst)
+	}
+
+	ah.whoisLatency = newHistogram(cfg.latencyBuckets)
+
+	// Build the identity resolution chain
+	var users map[string][]byte
+	if slices.Contains(cfg.identitySources, "basicauth") {
+		if users, err = loadHtpasswd(c.BasicAuthFile); err != nil {
+			return nil, fmt.Errorf("failed to load basic auth file: %v", err)
+		}
+	}
+	// Check cached profiles against the tailnet's peers when the WhoIs
+	// client can list them
+	var peers *peerIndex
+	if st, ok := whois.(statusGetter); ok {
+		peers = &peerIndex{client: st}
+	}
+	available := map[string]resolver{
+		"header": &headerResolver{
+			header:         c.IdentityHeader,
+			trustedProxies: cfg.trustedProxies,
+		},
+		"basicauth": &basicAuthResolver{users: users},
+		"token": &tokenResolver{
+			token:          c.BypassToken,
+			login:          c.BypassLogin,
+			queryToken:     c.QueryToken,
+			queryHosts:     cfg.queryTokenHosts,
+			trustedProxies: cfg.trustedProxies,
+		},
+		"whois": &whoisResolver{
+			client:           whois,
+			cache:            ah.profiles,
+			peers:            peers,
+			cacheExpiry:      c.CacheExpiry,
+			cacheKey:         c.CacheKey,
+			deviceHeaders:    c.DeviceHeaders,
+			forwardWhoIsJSON: c.ForwardWhoIsJSON,
+			latency:          ah.whoisLatency,
+			nameFallback:     c.NameFallback,
+			retries:          c.WhoIsRetries,
+			timeout:          c.WhoIsTimeout,
+		},
+	}
+	for _, name := range cfg.identitySources {
+		ah.resolvers = append(ah.resolvers, available[name])
+	}
+	return ah, nil
+}
+
+// close releases the connection to a shared cache, if any.
+func (ah *authHandler) close() {
+	if c, ok := ah.profiles.(*redisCache); ok {
+		_ = c.close()
+	}
+}
+
+// reload re-reads the policy file at path and swaps in its rules for
+// subsequent requests. The rules are left unchanged if it's invalid.
+func (ah *authHandler) reload(path string) error {
+	c, err := ah.Config.withPolicyFile(path)
+	if err != nil {
+		return err
+	}
+	cfg, err := c.parse()
+	if err != nil {
+		return err
+	}
+	ah.cfg.Store(cfg)
+	ah.settings.Store(c)
+
+	// Denials were decided under the previous rules
+	if ah.denials != nil {
+		ah.denials.purge()
+	}
+	return nil
+}
+
+// handler returns the handler wrapped in the configured middleware.
+func (ah *authHandler) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", ah)
+
+	var h http.Handler = mux
+	if ah.RejectInvalidHeaders {
+		h = headerValidationHandler(h)
+	}
+	if ah.ExposeTimingHeader {
+		h = timingHandler(h)
+	}
+	if ah.MaxConcurrent > 0 {
+		h = concurrencyLimitHandler(h, ah.MaxConcurrent)
+	}
+	h = tracingHandler(h)
+	if ah.AccessLog {
+		h = accessLogHandler(h, ah.AccessLogFormat)
+	}
+	return h
+}
+
+func (ah *authHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := ah.cfg.Load()
+
+	writeError := func(e *authError) {
+		if e.status == http.StatusUnauthorized && ah.LoginHintPage && acceptsHTML(r) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(e.status)
+			_, _ = io.WriteString(w, loginHintPage)
+			return
+		}
+		if ah.JSONErrors && acceptsJSON(r) {
+			writeJSON(w, e.status, e)
+			return
+		}
+		if ah.ResponseBody {
+			writeJSON(w, e.status, identityResponse{Error: errorCode(e.status)})
+			return
+		}
+		w.WriteHeader(e.status)
+	}
+
+	// allow authorizes the request, passing the identity of profile on
+	// to the gateway if there is one
+	allow := func(profile *userProfile) {
+		// Don't hand identity to an app over plain HTTP, where it could be
+		// read or forged in transit
+		if profile != nil && !ah.AllowInsecureIdentity && forwardedInsecure(r, ah.SchemeHeader, cfg.trustedProxies) {
+			slog.Warn("not sending identity for plain HTTP request", "host", forwardedHost(r), "login", profile.Login)
+			profile = nil
+		}
+
+		// Give the gateway the URI to forward without the query token, so
+		// it doesn't reach the app
+		if ah.AllowQueryToken {
+			if uri := forwardedURI(r); hasQueryToken(uri) {
+				w.Header().Set(HeaderTailscaleForwardURI, stripQueryToken(uri))
+			}
+		}
+
+		var body identityResponse
+		if profile != nil {
+			logEntryFromContext(r.Context()).Login = profile.Login
+
+			// Set headers
+			h := w.Header()
+			h.Set(HeaderTailscaleUserAvatar, profile.Avatar)
+			h.Set(HeaderTailscaleUserLogin, profile.Login)
+			h.Set(HeaderTailscaleUserName, profile.Name)
+			if profile.WhoIs != "" {
+				h.Set(HeaderTailscaleWhois, profile.WhoIs)
+			}
+			if profile.DeviceOS != "" {
+				h.Set(HeaderTailscaleDeviceOS, profile.DeviceOS)
+			}
+			if profile.DeviceModel != "" {
+				h.Set(HeaderTailscaleDeviceModel, profile.DeviceModel)
+			}
+			if ah.HeaderSigningKey != "" {
+				h.Set(HeaderTailscaleUserSig, SignIdentityHeaders([]byte(ah.HeaderSigningKey), h))
+			}
+			if cfg.compat != nil {
+				cfg.compat.setHeaders(h, profile)
+			}
+			body = identityResponse{
+				Avatar: profile.Avatar,
+				Login:  profile.Login,
+				Name:   profile.Name,
+			}
+		}
+		if ah.ResponseBody {
+			writeJSON(w, cfg.successStatus, body)
+			return
+		}
+		w.WriteHeader(cfg.successStatus)
+	}
+
+	// Reject clients speaking an older protocol than configured
+	if !r.ProtoAtLeast(cfg.minMajor, cfg.minMinor) {
+		writeError(statusError(http.StatusHTTPVersionNotSupported))
+		return
+	}
+
+	// Determine the remote address of the client. Without one, only
+	// identity sources that don't rely on it can resolve the client.
+	remoteAddr, err := clientAddr(r, cfg.trustedProxies, ah.ProxyProtocol)
+	if errors.Is(err, errUntrustedClient) {
+		writeError(authUnauthorized)
+		return
+	}
+	var remoteHost string
+	if err == nil {
+		remoteHost = remoteAddr.Addr().String()
+
+		// Tell the gateway which address was used to help debug how its
+		// headers are parsed
+		if ah.EchoRemoteAddr {
+			w.Header().Set(HeaderTailscaleResolvedAddr, remoteHost)
+			if remoteAddr.Port() != 0 {
+				w.Header().Set(HeaderTailscaleResolvedPort, strconv.Itoa(int(remoteAddr.Port())))
+			}
+		}
+	}
+
+	// Reject addresses denied by the CIDR policy, even if they're also
+	// within a trusted range
+	if remoteAddr.IsValid() && containsAddr(cfg.deniedCIDRs, remoteAddr.Addr()) {
+		writeError(authForbiddenCIDR)
+		return
+	}
+
+	// If the remote address is within the trusted CIDR range, allow access.
+	// IPv4-mapped IPv6 addresses are matched against the IPv4 ranges.
+	for _, cidr := range cfg.trustedCIDRs {
+		if cidr.Contains(remoteAddr.Addr().Unmap()) {
+			logEntryFromContext(r.Context()).TrustedCIDR = cidr
+			allow(cfg.trustedIdentity)
+			return
+		}
+	}
+
+	// Serve repeated denials for the same address, host and path from the
+	// denial cache. Requests presenting credentials skip it, as the denial
+	// was for the address and the credentials may identify someone else.
+	denialKey := remoteHost + " " + forwardedHost(r) + forwardedURI(r)
+	useDenials := ah.denials != nil && remoteHost != "" && !hasCredentials(r, ah.IdentityHeader)
+	if useDenials {
+		if denial, ok := ah.denials.get(denialKey); ok {
+			logEntryFromContext(r.Context()).CacheStatus = "negative"
+			writeError(denial)
+			return
+		}
+	}
+	// deny rejects the request for a reason that will hold on a retry,
+	// remembering it in the denial cache
+	deny := func(denial *authError) {
+		if useDenials {
+			ah.denials.set(denialKey, denial, ah.DenialCacheTTL)
+		}
+		writeError(denial)
+	}
+
+	// Resolve the identity of the client
+	profile, err := resolveIdentity(ah.resolvers, r, remoteAddr)
+	if errors.Is(err, errIncompleteWhoIs) {
+		// The peer is known but can't be identified as a user
+		deny(authForbiddenNoUser)
+		return
+	} else if errors.Is(err, context.DeadlineExceeded) {
+		// Don't remember the denial, the next lookup may succeed
+		writeError(authWhoIsTimeout)
+		return
+	} else if errors.Is(err, local.ErrPeerNotFound) {
+		// The address doesn't belong to the tailnet
+		deny(authUnauthorized)
+		return
+	} else if err != nil {
+		// Other failures, like the client going away or WhoIs errors
+		// that outlasted the retries, may not happen again
+		writeError(authUnauthorized)
+		return
+	}
+
+	// Warn the gateway when identity comes from an expired profile
+	if profile.stale {
+		w.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
+
+	// Evaluate the authorization rules for the identity
+	profile, denial := cfg.authorize(r, profile)
+	if denial != nil {
+		deny(denial)
+		return
+	}
+
+	// Enforce per-user rate limits
+	if profile != nil && ah.limiter != nil {
+		if ok, retryAfter := ah.limiter.allow(profile.Login); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			writeError(statusError(http.StatusTooManyRequests))
+			return
+		}
+	}
+
+	allow(profile)
+}
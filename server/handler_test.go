@@ -0,0 +1,619 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/tailcfg"
+)
+
+// fakeWhoIser answers WhoIs lookups from a map of addresses, with or
+// without their port, to responses.
+type fakeWhoIser map[string]*apitype.WhoIsResponse
+
+func (f fakeWhoIser) WhoIs(_ context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if info, ok := f[remoteAddr]; ok {
+		return info, nil
+	}
+	if addr, err := netip.ParseAddrPort(remoteAddr); err == nil {
+		if info, ok := f[addr.Addr().String()]; ok {
+			return info, nil
+		}
+	}
+	return nil, local.ErrPeerNotFound
+}
+
+var testWhoIs = fakeWhoIser{
+	"100.64.0.1": {
+		Node:        &tailcfg.Node{StableID: "n1"},
+		UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+	},
+	"100.64.0.2": {
+		Node: &tailcfg.Node{StableID: "n2", Tags: []string{"tag:ci"}},
+	},
+}
+
+// testConfig returns valid handler settings resolving identities with WhoIs.
+func testConfig() Config {
+	return Config{
+		Policy: Policy{
+			DefaultPolicy:    defaultPolicyAllow,
+			TaggedNodePolicy: taggedNodeAllowSpecific,
+		},
+		AccessLogFormat: accessLogFormatText,
+		CacheCostMode:   cacheCostModeCount,
+		CacheExpiry:     time.Minute,
+		CacheKey:        cacheKeyAddress,
+		CacheSize:       100,
+		IdentitySources: "whois",
+		MinHTTPVersion:  "1.0",
+		SchemeHeader:    "X-Forwarded-Proto",
+	}
+}
+
+// newTestRequest returns a forward-auth request from the tailnet peer at addr.
+func newTestRequest(addr string) *http.Request {
+	peer := netip.MustParseAddrPort(addr)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(HeaderTailscaleRemoteAddr, peer.Addr().String())
+	r.Header.Set(HeaderTailscaleRemotePort, strconv.Itoa(int(peer.Port())))
+	return r
+}
+
+func TestNewAuthHandler(t *testing.T) {
+	h, err := NewAuthHandler(testConfig(), testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		wantStatus int
+		wantLogin  string
+	}{
+		{"100.64.0.1:41641", http.StatusOK, "alice@example.com"},
+		// Tagged nodes need a trusted tag with the allow-specific policy
+		{"100.64.0.2:41641", http.StatusForbidden, ""},
+		{"100.64.0.3:41641", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			addr := netip.MustParseAddrPort(tt.remoteAddr)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(HeaderTailscaleRemoteAddr, addr.Addr().String())
+			r.Header.Set(HeaderTailscaleRemotePort, strconv.Itoa(int(addr.Port())))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get(HeaderTailscaleUserLogin); got != tt.wantLogin {
+				t.Errorf("%s = %q, want %q", HeaderTailscaleUserLogin, got, tt.wantLogin)
+			}
+		})
+	}
+}
+
+func TestNewAuthHandlerDefaultConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.AccessLog = false
+	h, err := NewAuthHandler(cfg, testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remoteAddr string
+		wantStatus int
+		wantLogin  string
+	}{
+		{"100.64.0.1:41641", http.StatusOK, "alice@example.com"},
+		// Tagged nodes need a trusted tag with the allow-specific default
+		{"100.64.0.2:41641", http.StatusForbidden, ""},
+		{"100.64.0.3:41641", http.StatusUnauthorized, ""},
+		// Within the default trusted CIDR
+		{"10.42.1.1:41641", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.remoteAddr, func(t *testing.T) {
+			addr := netip.MustParseAddrPort(tt.remoteAddr)
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(HeaderTailscaleRemoteAddr, addr.Addr().String())
+			r.Header.Set(HeaderTailscaleRemotePort, strconv.Itoa(int(addr.Port())))
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get(HeaderTailscaleUserLogin); got != tt.wantLogin {
+				t.Errorf("%s = %q, want %q", HeaderTailscaleUserLogin, got, tt.wantLogin)
+			}
+		})
+	}
+}
+
+func TestNewAuthHandlerZeroConfig(t *testing.T) {
+	if _, err := NewAuthHandler(Config{}, testWhoIs); err == nil {
+		t.Error("NewAuthHandler accepted a zero Config")
+	}
+}
+
+func TestTaggedNodePolicy(t *testing.T) {
+	tests := []struct {
+		policy      string
+		trustedTags string
+		wantStatus  int
+		wantLogin   string
+	}{
+		{taggedNodeForbid, "tag:ci", http.StatusForbidden, ""},
+		{taggedNodeAllow, "", http.StatusOK, "tag:ci"},
+		{taggedNodeAllowSpecific, "", http.StatusForbidden, ""},
+		{taggedNodeAllowSpecific, "tag:ci", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy+"/"+tt.trustedTags, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.TaggedNodePolicy = tt.policy
+			cfg.TrustedTags = tt.trustedTags
+			h, err := NewAuthHandler(cfg, testWhoIs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest("GET", "/", nil)
+			r.Header.Set(HeaderTailscaleRemoteAddr, "100.64.0.2")
+			r.Header.Set(HeaderTailscaleRemotePort, "41641")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get(HeaderTailscaleUserLogin); got != tt.wantLogin {
+				t.Errorf("%s = %q, want %q", HeaderTailscaleUserLogin, got, tt.wantLogin)
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.DenialCacheTTL = time.Minute
+	parsed, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ah, err := newAuthHandler(&cfg, parsed, testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ah.denials.set("100.64.0.3 app.example.com/", authUnauthorized, time.Minute)
+	ah.denials.client.Wait()
+
+	path := filepath.Join(t.TempDir(), "policy.json")
+	policy := `{"default_policy": "deny", "trusted_tags": "tag:ci"}`
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ah.reload(path); err != nil {
+		t.Fatal(err)
+	}
+
+	settings := ah.settings.Load()
+	if settings.DefaultPolicy != "deny" || settings.TrustedTags != "tag:ci" {
+		t.Errorf("settings after reload = %+v, want the policy file applied", settings.Policy)
+	}
+	if ah.DefaultPolicy != "allow" {
+		t.Errorf("flag settings changed by reload: DefaultPolicy = %q", ah.DefaultPolicy)
+	}
+	if _, ok := ah.denials.get("100.64.0.3 app.example.com/"); ok {
+		t.Error("denial survived reload")
+	}
+
+	// Rules dropped from the file revert to their flags
+	if err := os.WriteFile(path, []byte(`{"trusted_tags": "tag:ci"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ah.reload(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := ah.settings.Load().DefaultPolicy; got != "allow" {
+		t.Errorf("DefaultPolicy after it was dropped from the file = %q, want the flag's allow", got)
+	}
+
+	// Unknown keys, including the Go field names, are rejected
+	if err := os.WriteFile(path, []byte(`{"DefaultPolicy": "deny"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ah.reload(path); err == nil {
+		t.Error("reload accepted an unknown key")
+	}
+}
+
+func TestInsecureIdentity(t *testing.T) {
+	tests := []struct {
+		proto     string
+		allow     bool
+		wantLogin string
+	}{
+		{"https", false, "alice@example.com"},
+		{"", false, "alice@example.com"},
+		{"http", false, ""},
+		{"http", true, "alice@example.com"},
+	}
+	for _, tt := range tests {
+		cfg := testConfig()
+		cfg.AllowInsecureIdentity = tt.allow
+		h, err := NewAuthHandler(cfg, testWhoIs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(HeaderTailscaleRemoteAddr, "100.64.0.1")
+		r.Header.Set(HeaderTailscaleRemotePort, "41641")
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Errorf("proto %q, allow %v: status = %d, want %d", tt.proto, tt.allow, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get(HeaderTailscaleUserLogin); got != tt.wantLogin {
+			t.Errorf("proto %q, allow %v: %s = %q, want %q", tt.proto, tt.allow, HeaderTailscaleUserLogin, got, tt.wantLogin)
+		}
+	}
+}
+
+func TestEchoRemoteAddr(t *testing.T) {
+	cfg := testConfig()
+	cfg.EchoRemoteAddr = true
+	h, err := NewAuthHandler(cfg, testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The address is echoed on denials too
+	for _, addr := range []string{"100.64.0.1", "100.64.0.3"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(HeaderTailscaleRemoteAddr, addr)
+		r.Header.Set(HeaderTailscaleRemotePort, "41641")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if got := w.Header().Get(HeaderTailscaleResolvedAddr); got != addr {
+			t.Errorf("%s = %q, want %q", HeaderTailscaleResolvedAddr, got, addr)
+		}
+		if got := w.Header().Get(HeaderTailscaleResolvedPort); got != "41641" {
+			t.Errorf("%s = %q, want 41641", HeaderTailscaleResolvedPort, got)
+		}
+	}
+}
+
+func TestCIDRPolicy(t *testing.T) {
+	cfg := testConfig()
+	cfg.CIDRPolicy = "allow:10.0.0.0/8,deny:10.1.0.0/16"
+	h, err := NewAuthHandler(cfg, testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr       string
+		wantStatus int
+	}{
+		{"10.2.0.1", http.StatusOK},
+		{"::ffff:10.2.0.1", http.StatusOK},
+		// Deny takes precedence over allow
+		{"10.1.0.1", http.StatusForbidden},
+		{"::ffff:10.1.0.1", http.StatusForbidden},
+		{"192.0.2.1", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(HeaderTailscaleRemoteAddr, tt.addr)
+		r.Header.Set(HeaderTailscaleRemotePort, "41641")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.addr, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	cfg := testConfig()
+	cfg.RateLimit = 1
+	cfg.RateBurst = 2
+	h, err := NewAuthHandler(cfg, testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range 2 {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest("100.64.0.1:41641"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d within the burst: status = %d, want %d", i+1, w.Code, http.StatusOK)
+		}
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("100.64.0.1:41641"))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("request beyond the burst: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+	}
+	if got := w.Header().Get("Retry-After"); got != "1" {
+		t.Errorf("Retry-After = %q, want 1", got)
+	}
+}
+
+// countingWhoIser counts the lookups passed on to its WhoIser.
+type countingWhoIser struct {
+	WhoIser
+	calls atomic.Int32
+}
+
+func (c *countingWhoIser) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	c.calls.Add(1)
+	return c.WhoIser.WhoIs(ctx, remoteAddr)
+}
+
+func TestPurgeReresolves(t *testing.T) {
+	cfg := testConfig()
+	parsed, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	whois := &countingWhoIser{WhoIser: testWhoIs}
+	ah, err := newAuthHandler(&cfg, parsed, whois)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ah.handler()
+	admin := (&Server{}).adminHandler(ah, new(atomic.Bool), nil)
+	serve := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest("100.64.0.1:41641"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+		}
+	}
+
+	serve()
+	serve()
+	if got := whois.calls.Load(); got != 1 {
+		t.Fatalf("%d WhoIs lookups before the purge, want 1", got)
+	}
+	hits := ah.cache.stats().Hits
+	if hits == 0 {
+		t.Fatal("second request wasn't a cache hit")
+	}
+
+	w := httptest.NewRecorder()
+	admin.ServeHTTP(w, httptest.NewRequest("POST", "/admin/cache/purge", nil))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("purge status = %d, want %d", w.Code, http.StatusNoContent)
+	}
+	serve()
+	if got := whois.calls.Load(); got != 2 {
+		t.Errorf("%d WhoIs lookups after the purge, want 2", got)
+	}
+
+	// The counters aren't reset by the purge
+	stats := ah.cache.stats()
+	if stats.Hits < hits || stats.Misses < 2 {
+		t.Errorf("stats after purge = %+v, want the earlier hit and both misses", stats)
+	}
+}
+
+// flakyWhoIser fails the first failures lookups with a transient error
+// before passing them on to its WhoIser.
+type flakyWhoIser struct {
+	countingWhoIser
+	failures int32
+}
+
+func (f *flakyWhoIser) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	if f.calls.Add(1) <= f.failures {
+		return nil, errors.New("connection refused")
+	}
+	return f.WhoIser.WhoIs(ctx, remoteAddr)
+}
+
+func TestWhoIsRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		addr       string
+		failures   int32
+		retries    int
+		wantStatus int
+		wantCalls  int32
+	}{
+		{"transient error retried", "100.64.0.1:41641", 1, 1, http.StatusOK, 2},
+		{"retries exhausted", "100.64.0.1:41641", 2, 1, http.StatusUnauthorized, 2},
+		{"unknown peer not retried", "100.64.0.3:41641", 0, 1, http.StatusUnauthorized, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.WhoIsRetries = tt.retries
+			whois := &flakyWhoIser{countingWhoIser: countingWhoIser{WhoIser: testWhoIs}, failures: tt.failures}
+			h, err := NewAuthHandler(cfg, whois)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, newTestRequest(tt.addr))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := whois.calls.Load(); got != tt.wantCalls {
+				t.Errorf("%d WhoIs lookups, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	cfg := testConfig()
+	cfg.CacheExpiry = time.Millisecond
+	cfg.StaleWhileRevalidate = time.Hour
+	parsed, err := cfg.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	whois := &countingWhoIser{WhoIser: testWhoIs}
+	ah, err := newAuthHandler(&cfg, parsed, whois)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := ah.handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("100.64.0.1:41641"))
+	if got := w.Header().Get("Warning"); got != "" {
+		t.Errorf("fresh response has Warning %q", got)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	// The expired profile is served, flagged as stale, while it's
+	// refreshed in the background
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, newTestRequest("100.64.0.1:41641"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got, want := w.Header().Get("Warning"), `110 - "Response is Stale"`; got != want {
+		t.Errorf("Warning = %q, want %q", got, want)
+	}
+	if got := w.Header().Get(HeaderTailscaleUserLogin); got != "alice@example.com" {
+		t.Errorf("%s = %q, want alice@example.com", HeaderTailscaleUserLogin, got)
+	}
+	if got := ah.cache.stats().StaleHits; got != 1 {
+		t.Errorf("stale hits = %d, want 1", got)
+	}
+	deadline := time.Now().Add(time.Second)
+	for whois.calls.Load() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := whois.calls.Load(); got != 2 {
+		t.Errorf("%d WhoIs lookups, want the stale profile refreshed", got)
+	}
+}
+
+func TestLoginHintPage(t *testing.T) {
+	cfg := testConfig()
+	cfg.LoginHintPage = true
+	cfg.JSONErrors = true
+	h, err := NewAuthHandler(cfg, testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		accept          string
+		wantContentType string
+	}{
+		{"text/html,application/xhtml+xml,*/*;q=0.8", "text/html; charset=utf-8"},
+		{"application/json", "application/json"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			// The address isn't on the tailnet
+			r := newTestRequest("100.64.0.3:41641")
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantContentType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantContentType)
+			}
+			if isHTML := strings.Contains(w.Body.String(), "<html"); isHTML != strings.HasPrefix(tt.wantContentType, "text/html") {
+				t.Errorf("body = %q", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestDeviceHeaders(t *testing.T) {
+	whois := fakeWhoIser{
+		"100.64.0.1": {
+			Node: &tailcfg.Node{
+				StableID: "n1",
+				Hostinfo: (&tailcfg.Hostinfo{OS: "iOS", DeviceModel: "iPhone15,2"}).View(),
+			},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice"},
+		},
+	}
+	for _, enabled := range []bool{false, true} {
+		cfg := testConfig()
+		cfg.DeviceHeaders = enabled
+		h, err := NewAuthHandler(cfg, whois)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest("100.64.0.1:41641"))
+		wantOS, wantModel := "", ""
+		if enabled {
+			wantOS, wantModel = "iOS", "iPhone15,2"
+		}
+		if got := w.Header().Get(HeaderTailscaleDeviceOS); got != wantOS {
+			t.Errorf("device headers %v: %s = %q, want %q", enabled, HeaderTailscaleDeviceOS, got, wantOS)
+		}
+		if got := w.Header().Get(HeaderTailscaleDeviceModel); got != wantModel {
+			t.Errorf("device headers %v: %s = %q, want %q", enabled, HeaderTailscaleDeviceModel, got, wantModel)
+		}
+	}
+}
+
+func TestLongAvatarDropped(t *testing.T) {
+	long := "https://example.com/" + strings.Repeat("a", maxAvatarLength)
+	whois := fakeWhoIser{
+		"100.64.0.1": {
+			Node:        &tailcfg.Node{StableID: "n1"},
+			UserProfile: &tailcfg.UserProfile{LoginName: "alice@example.com", DisplayName: "Alice", ProfilePicURL: "https://example.com/alice.png"},
+		},
+		"100.64.0.2": {
+			Node:        &tailcfg.Node{StableID: "n2"},
+			UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com", DisplayName: "Bob", ProfilePicURL: long},
+		},
+	}
+	h, err := NewAuthHandler(testConfig(), whois)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr       string
+		wantAvatar string
+	}{
+		{"100.64.0.1:41641", "https://example.com/alice.png"},
+		{"100.64.0.2:41641", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, newTestRequest(tt.addr))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want %d", tt.addr, w.Code, http.StatusOK)
+		}
+		if got := w.Header().Get(HeaderTailscaleUserAvatar); got != tt.wantAvatar {
+			t.Errorf("%s: %s = %.40q, want %q", tt.addr, HeaderTailscaleUserAvatar, got, tt.wantAvatar)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// parseBuckets parses a comma-separated list of bucket upper bounds in
+// seconds, which must be positive and in increasing order.
+func parseBuckets(s string) ([]float64, error) {
+	var bounds []float64
+	for _, b := range strings.Split(s, ",") {
+		if b = strings.TrimSpace(b); b == "" {
+			continue
+		}
+		bound, err := strconv.ParseFloat(b, 64)
+		if err != nil || bound <= 0 || math.IsInf(bound, 0) {
+			return nil, fmt.Errorf("bucket must be a positive number of seconds: %s", b)
+		}
+		if len(bounds) > 0 && bound <= bounds[len(bounds)-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order: %s", s)
+		}
+		bounds = append(bounds, bound)
+	}
+	return bounds, nil
+}
+
+// histogram counts durations into buckets by their upper bound.
+type histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds: bounds,
+		counts: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if i, _ := slices.BinarySearch(h.bounds, v); i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+type histogramBucket struct {
+	LE    float64 `json:"le"`
+	Count uint64  `json:"count"`
+}
+
+type histogramStats struct {
+	Buckets []histogramBucket `json:"buckets"`
+	Count   uint64            `json:"count"`
+	Sum     float64           `json:"sum"`
+}
+
+// stats returns cumulative bucket counts like a Prometheus histogram; the
+// count includes observations above the largest bound.
+func (h *histogram) stats() histogramStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	stats := histogramStats{Count: h.count, Sum: h.sum}
+	var cumulative uint64
+	for i, bound := range h.bounds {
+		cumulative += h.counts[i]
+		stats.Buckets = append(stats.Buckets, histogramBucket{LE: bound, Count: cumulative})
+	}
+	return stats
+}
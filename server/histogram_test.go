@@ -0,0 +1,54 @@
+package server
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParseBuckets(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    []float64
+		wantErr bool
+	}{
+		{s: "0.005, 0.1,1", want: []float64{0.005, 0.1, 1}},
+		{s: "", want: nil},
+		{s: "0", wantErr: true},
+		{s: "-1", wantErr: true},
+		{s: "inf", wantErr: true},
+		{s: "1ms", wantErr: true},
+		{s: "1,0.5", wantErr: true},
+		{s: "1,1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseBuckets(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseBuckets(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+			continue
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("parseBuckets(%q) = %v, want %v", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{0.01, 0.1, 1})
+	for _, d := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 50 * time.Millisecond, 2 * time.Second} {
+		h.observe(d)
+	}
+	stats := h.stats()
+
+	// Buckets are cumulative and include their upper bound
+	want := []histogramBucket{{LE: 0.01, Count: 2}, {LE: 0.1, Count: 3}, {LE: 1, Count: 3}}
+	if !slices.Equal(stats.Buckets, want) {
+		t.Errorf("buckets = %v, want %v", stats.Buckets, want)
+	}
+	if stats.Count != 4 {
+		t.Errorf("count = %d, want 4 including the observation above the largest bound", stats.Count)
+	}
+	if stats.Sum < 2.065 || stats.Sum > 2.066 {
+		t.Errorf("sum = %v, want 2.065", stats.Sum)
+	}
+}
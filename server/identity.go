@@ -0,0 +1,535 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/sync/singleflight"
+	"tailscale.com/client/local"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+)
+
+const (
+	cacheKeyAddress = "address"
+	cacheKeyLogin   = "login"
+)
+
+// cacheKeys lists the values the profile cache can be keyed by.
+var cacheKeys = []string{cacheKeyAddress, cacheKeyLogin}
+
+// whoisRetryBackoff is the delay before the first WhoIs retry, doubling
+// with each subsequent attempt.
+const whoisRetryBackoff = 100 * time.Millisecond
+
+// peerIndexRefresh is how often the peer index is rebuilt from the node's
+// status, bounding how long a reassigned address can serve the profile of
+// the node it previously belonged to.
+const peerIndexRefresh = 5 * time.Second
+
+// maxAvatarLength is the longest avatar URL passed on in headers. Longer
+// URLs are dropped rather than truncated into broken links, so they can't
+// push the gateway's request to the app past its header limits.
+const maxAvatarLength = 2048
+
+// defaultLookupTimeout bounds a WhoIs lookup when no timeout is configured.
+// Lookups are detached from the requests waiting on them, so without a
+// bound a hung tailscaled would pin the lookup and its key forever.
+const defaultLookupTimeout = 30 * time.Second
+
+// identitySources lists the names of the identity sources that can be
+// configured, in the default resolution order.
+var identitySources = []string{"token", "header", "basicauth", "whois"}
+
+// errNotResolved is returned by a resolver when its identity source doesn't
+// apply to the request, so the next resolver in the chain should be tried.
+var errNotResolved = errors.New("identity not resolved")
+
+// errIncompleteWhoIs is returned when WhoIs finds the peer but the response
+// is missing its node or, for untagged nodes, its user profile.
+var errIncompleteWhoIs = errors.New("incomplete WhoIs response")
+
+// resolver resolves the identity of the client a request is authorized for.
+type resolver interface {
+	resolve(r *http.Request, addr netip.AddrPort) (*userProfile, error)
+}
+
+// resolveIdentity tries each resolver in order until one resolves the
+// request.
+func resolveIdentity(resolvers []resolver, r *http.Request, addr netip.AddrPort) (*userProfile, error) {
+	for _, res := range resolvers {
+		profile, err := res.resolve(r, addr)
+		if errors.Is(err, errNotResolved) {
+			continue
+		}
+		return profile, err
+	}
+	return nil, errNotResolved
+}
+
+// hasCredentials reports whether the request presents credentials of its
+// own, in the Authorization header, the identity header or the query token,
+// rather than being identified by its address alone.
+func hasCredentials(r *http.Request, identityHeader string) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	if identityHeader != "" && r.Header.Get(identityHeader) != "" {
+		return true
+	}
+	return hasQueryToken(forwardedURI(r))
+}
+
+// queryTokenParam is the query parameter of the original request that can
+// carry the query token for clients which can't set headers, such as
+// EventSource or image tags.
+//
+// Forward auth can't rewrite the request the gateway sends on to the app,
+// so authorized responses give the gateway the URI without the parameter
+// in the Tailscale-Forward-Uri header to forward instead. It's redacted from
+// the proxy's own access log.
+const queryTokenParam = "ts_token"
+
+// isQueryTokenParam reports whether param, a key=value pair from a raw
+// query, is the query token, however its key is escaped.
+func isQueryTokenParam(param string) bool {
+	key, _, _ := strings.Cut(param, "=")
+	key, err := url.QueryUnescape(key)
+	return err == nil && key == queryTokenParam
+}
+
+// hasQueryToken reports whether uri has the query token parameter.
+func hasQueryToken(uri string) bool {
+	_, query, _ := strings.Cut(uri, "?")
+	return slices.ContainsFunc(strings.Split(query, "&"), isQueryTokenParam)
+}
+
+// stripQueryToken returns uri without the query token parameter.
+func stripQueryToken(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	params := slices.DeleteFunc(strings.Split(query, "&"), isQueryTokenParam)
+	if len(params) == 0 {
+		return path
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// tokenResolver authorizes machine-to-machine clients presenting a shared
+// bearer token as a fixed synthetic login.
+type tokenResolver struct {
+	token string
+	login string
+	// queryToken is accepted in the query of the original request, but
+	// only for requests to queryHosts forwarded by trustedProxies. It's
+	// separate from the bypass token as URLs leak into browser history,
+	// referrers and logs.
+	queryToken     string
+	queryHosts     []string
+	trustedProxies []netip.Prefix
+}
+
+func (res *tokenResolver) resolve(r *http.Request, _ netip.AddrPort) (*userProfile, error) {
+	if auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && res.token != "" {
+		if subtle.ConstantTimeCompare([]byte(auth), []byte(res.token)) == 1 {
+			return &userProfile{Login: res.login, Name: res.login, bypass: true}, nil
+		}
+	}
+	if host, ok := trustedForwardedHost(r, res.trustedProxies); ok && res.queryToken != "" && slices.Contains(res.queryHosts, host) {
+		if u, err := url.ParseRequestURI(forwardedURI(r)); err == nil && u.Query().Has(queryTokenParam) {
+			if subtle.ConstantTimeCompare([]byte(u.Query().Get(queryTokenParam)), []byte(res.queryToken)) == 1 {
+				return &userProfile{Login: res.login, Name: res.login, bypass: true}, nil
+			}
+		}
+	}
+	// Fall through to the next identity source
+	return nil, errNotResolved
+}
+
+// headerResolver trusts the login given in a header by a trusted proxy
+// that has already authenticated the client, e.g. X-Forwarded-User.
+type headerResolver struct {
+	header         string
+	trustedProxies []netip.Prefix
+}
+
+func (res *headerResolver) resolve(r *http.Request, _ netip.AddrPort) (*userProfile, error) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !containsAddr(res.trustedProxies, peer.Addr()) {
+		return nil, errNotResolved
+	}
+	login := strings.TrimSpace(r.Header.Get(res.header))
+	if login == "" {
+		return nil, errNotResolved
+	}
+	return &userProfile{Login: login, Name: login}, nil
+}
+
+// basicAuthResolver authenticates clients with HTTP basic auth credentials
+// checked against bcrypt hashes from an htpasswd file.
+type basicAuthResolver struct {
+	users map[string][]byte
+}
+
+// loadHtpasswd reads login:bcrypt-hash lines from path, skipping blank
+// lines and # comments.
+func loadHtpasswd(path string) (map[string][]byte, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string][]byte)
+	for i, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		login, hash, ok := strings.Cut(line, ":")
+		if !ok || login == "" {
+			return nil, fmt.Errorf("%s:%d: expected login:hash", path, i+1)
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported: %v", path, i+1, err)
+		}
+		users[login] = []byte(hash)
+	}
+	return users, nil
+}
+
+func (res *basicAuthResolver) resolve(r *http.Request, _ netip.AddrPort) (*userProfile, error) {
+	login, password, ok := r.BasicAuth()
+	if !ok {
+		return nil, errNotResolved
+	}
+	hash, ok := res.users[login]
+	if !ok || bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		// Fall through to the next identity source
+		return nil, errNotResolved
+	}
+	return &userProfile{Login: login, Name: login}, nil
+}
+
+// redactQueryToken replaces the value of the query token in uri so it
+// isn't written to logs.
+func redactQueryToken(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return uri
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		if isQueryTokenParam(param) {
+			params[i] = queryTokenParam + "=REDACTED"
+		}
+	}
+	return path + "?" + strings.Join(params, "&")
+}
+
+// nameFallbacks lists the ways a name can be derived from the login when a
+// user has no display name.
+var nameFallbacks = []string{"", "login", "login-local"}
+
+// fallbackName derives a name from login: the whole login for "login", or
+// the part before the @ for "login-local".
+func fallbackName(login, fallback string) string {
+	switch fallback {
+	case "login":
+		return login
+	case "login-local":
+		local, _, _ := strings.Cut(login, "@")
+		return local
+	default:
+		return ""
+	}
+}
+
+// WhoIser looks up the node and user behind a Tailscale address. It's
+// satisfied by the tsnet local client, and lets the WhoIs resolver be used
+// without a real tailnet.
+type WhoIser interface {
+	WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error)
+}
+
+var _ WhoIser = (*local.Client)(nil)
+
+// statusGetter reports the node's view of the tailnet, including its peers.
+// The tsnet local client satisfies it.
+type statusGetter interface {
+	Status(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// peerIndex maps Tailscale addresses to the node they're assigned to, from
+// the node's status. It's rebuilt at most every peerIndexRefresh so cached
+// profiles can be checked against it on every hit without a WhoIs lookup.
+type peerIndex struct {
+	client statusGetter
+
+	mu      sync.Mutex
+	nodes   map[netip.Addr]tailcfg.StableNodeID
+	updated time.Time
+}
+
+// nodeID returns the node addr is currently assigned to, or false if that
+// isn't known.
+func (p *peerIndex) nodeID(ctx context.Context, addr netip.Addr) (tailcfg.StableNodeID, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if time.Since(p.updated) >= peerIndexRefresh {
+		st, err := p.client.Status(ctx)
+		if err != nil {
+			slog.Debug("failed to refresh peer index", "error", err)
+		} else {
+			p.nodes = make(map[netip.Addr]tailcfg.StableNodeID, len(st.Peer))
+			for _, peer := range st.Peer {
+				for _, ip := range peer.TailscaleIPs {
+					p.nodes[ip] = peer.ID
+				}
+			}
+		}
+		// Failures are retried on the next refresh rather than on every
+		// request
+		p.updated = time.Now()
+	}
+	id, ok := p.nodes[addr.Unmap()]
+	return id, ok
+}
+
+// whoisResolver resolves identities by looking up the client address with
+// Tailscale, caching the resulting profiles.
+type whoisResolver struct {
+	client           WhoIser
+	cache            profileCache
+	peers            *peerIndex
+	cacheExpiry      time.Duration
+	cacheKey         string
+	deviceHeaders    bool
+	forwardWhoIsJSON bool
+	latency          *histogram
+	nameFallback     string
+	retries          int
+	timeout          time.Duration
+
+	// Coalesce concurrent lookups of the same address so only one WhoIs and
+	// cache write happens per key at a time
+	lookups singleflight.Group
+}
+
+func (res *whoisResolver) resolve(r *http.Request, addr netip.AddrPort) (_ *userProfile, err error) {
+	if !addr.IsValid() {
+		return nil, errNotResolved
+	}
+	remoteHost := addr.Addr().String()
+
+	ctx, span := tracer().Start(r.Context(), "whois", trace.WithAttributes(
+		attribute.String("client.address", remoteHost),
+	))
+	entry := logEntryFromContext(ctx)
+	defer func() {
+		span.SetAttributes(
+			attribute.Bool("cache.hit", entry.CacheStatus != "miss"),
+			attribute.String("cache.status", entry.CacheStatus),
+		)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}()
+
+	// Get user profile from cache if available, unless the address has
+	// since been reassigned to another node
+	if profile, err := res.cached(ctx, remoteHost); err == nil && !res.reassigned(ctx, addr.Addr(), profile) {
+		if !profile.expired() {
+			entry.CacheStatus = "hit"
+			return profile, nil
+		}
+
+		// Serve the expired profile while it's refreshed in the background
+		entry.CacheStatus = "stale"
+		res.cache.recordStaleHit()
+		res.lookups.DoChan(remoteHost, res.lookup(context.WithoutCancel(ctx), addr))
+		stale := *profile
+		stale.stale = true
+		return &stale, nil
+	}
+	entry.CacheStatus = "miss"
+
+	// Fallback to tailscale if cache miss. The shared lookup isn't tied to
+	// the request that started it, so one caller going away doesn't fail
+	// the others waiting on the same key.
+	ch := res.lookups.DoChan(remoteHost, res.lookup(context.WithoutCancel(ctx), addr))
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-ch:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*userProfile), nil
+	}
+}
+
+// reassigned reports whether addr now belongs to a different node than the
+// one its cached profile was resolved for, dropping the profile if so.
+// Profiles are assumed current when there's no peer index or the address
+// isn't in it.
+func (res *whoisResolver) reassigned(ctx context.Context, addr netip.Addr, profile *userProfile) bool {
+	if res.peers == nil || profile.NodeID == "" {
+		return false
+	}
+	id, ok := res.peers.nodeID(ctx, addr)
+	if !ok || id == profile.NodeID {
+		return false
+	}
+	slog.Debug("address reassigned, dropping cached profile", "addr", addr, "cached_node", profile.NodeID, "node", id)
+	_ = res.cache.delete(ctx, addr.String())
+	return true
+}
+
+// lookup returns a function that fetches the profile for addr from
+// Tailscale and caches it.
+func (res *whoisResolver) lookup(ctx context.Context, addr netip.AddrPort) func() (any, error) {
+	return func() (any, error) {
+		remoteHost := addr.Addr().String()
+
+		// Fetch user info from tailscale
+		whoisAddr := addr.String()
+		if addr.Port() == 0 {
+			whoisAddr = remoteHost
+		}
+		timeout := res.timeout
+		if timeout <= 0 {
+			timeout = defaultLookupTimeout
+		}
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		start := time.Now()
+		info, err := res.whois(ctx, whoisAddr)
+		if res.latency != nil {
+			res.latency.observe(time.Since(start))
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.Node == nil || (!info.Node.IsTagged() && info.UserProfile == nil) {
+			slog.Warn("WhoIs response has no node or user profile", "addr", whoisAddr)
+			return nil, errIncompleteWhoIs
+		}
+
+		// Cache user profile. Tagged nodes don't identify a user, so only
+		// their tags are recorded.
+		profile := &userProfile{NodeID: info.Node.StableID}
+		if info.Node.IsTagged() {
+			profile.Tags = info.Node.Tags
+		} else {
+			profile.Avatar = info.UserProfile.ProfilePicURL
+			if len(profile.Avatar) > maxAvatarLength {
+				slog.Debug("dropping long avatar URL", "login", info.UserProfile.LoginName, "length", len(profile.Avatar))
+				profile.Avatar = ""
+			}
+			profile.Login = info.UserProfile.LoginName
+			profile.Name = info.UserProfile.DisplayName
+			if profile.Name == "" {
+				profile.Name = fallbackName(profile.Login, res.nameFallback)
+			}
+		}
+		if res.deviceHeaders && info.Node.Hostinfo.Valid() {
+			profile.DeviceOS = info.Node.Hostinfo.OS()
+			profile.DeviceModel = info.Node.Hostinfo.DeviceModel()
+		}
+		for c := range info.CapMap {
+			profile.Capabilities = append(profile.Capabilities, c)
+		}
+		if res.forwardWhoIsJSON {
+			if profile.WhoIs, err = encodeWhoIs(info); err != nil {
+				return nil, err
+			}
+		}
+		res.store(ctx, remoteHost, profile)
+		return profile, nil
+	}
+}
+
+// loginCacheKey returns the key the user details for login are cached under
+// when caching by login.
+func loginCacheKey(login string) string {
+	return "login:" + login
+}
+
+// cached returns the cached profile for host. When caching by login, the
+// node's entry is merged with the entry of its user, and the result expires
+// when either of them does.
+func (res *whoisResolver) cached(ctx context.Context, host string) (*userProfile, error) {
+	profile, err := res.cache.get(ctx, host)
+	if err != nil || res.cacheKey != cacheKeyLogin || profile.Login == "" {
+		return profile, err
+	}
+	user, err := res.cache.get(ctx, loginCacheKey(profile.Login))
+	if err != nil {
+		return nil, err
+	}
+	merged := *profile
+	merged.Avatar = user.Avatar
+	merged.Name = user.Name
+	if !user.Expires.IsZero() && (merged.Expires.IsZero() || user.Expires.Before(merged.Expires)) {
+		merged.Expires = user.Expires
+	}
+	return &merged, nil
+}
+
+// store caches the profile for host. When caching by login, the user's
+// details are stored once under their login and shared by all of their
+// devices; only the details specific to the node, like its capabilities,
+// are stored per address.
+func (res *whoisResolver) store(ctx context.Context, host string, profile *userProfile) {
+	if res.cacheKey != cacheKeyLogin || profile.Login == "" {
+		_ = res.cache.set(ctx, host, profile, res.cacheExpiry)
+		return
+	}
+	user := &userProfile{
+		Avatar: profile.Avatar,
+		Login:  profile.Login,
+		Name:   profile.Name,
+	}
+	node := *profile
+	node.Avatar = ""
+	node.Name = ""
+	_ = res.cache.set(ctx, loginCacheKey(profile.Login), user, res.cacheExpiry)
+	_ = res.cache.set(ctx, host, &node, res.cacheExpiry)
+}
+
+// whois looks up addr, retrying errors that look transient. Unknown peers
+// aren't retried as another attempt won't find them either.
+func (res *whoisResolver) whois(ctx context.Context, addr string) (*apitype.WhoIsResponse, error) {
+	backoff := whoisRetryBackoff
+	for attempt := 0; ; attempt++ {
+		info, err := res.client.WhoIs(ctx, addr)
+		if err == nil || attempt >= res.retries || errors.Is(err, local.ErrPeerNotFound) {
+			return info, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
@@ -0,0 +1,498 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// stubResolver resolves every request to its profile or error, and counts
+// how often it was asked.
+type stubResolver struct {
+	profile *userProfile
+	err     error
+	calls   int
+}
+
+func (s *stubResolver) resolve(*http.Request, netip.AddrPort) (*userProfile, error) {
+	s.calls++
+	return s.profile, s.err
+}
+
+func TestResolveIdentity(t *testing.T) {
+	alice := &userProfile{Login: "alice@example.com"}
+	bob := &userProfile{Login: "bob@example.com"}
+	errLookup := errors.New("lookup failed")
+
+	tests := []struct {
+		name      string
+		chain     []*stubResolver
+		wantLogin string
+		wantErr   error
+		wantCalls []int
+	}{
+		{
+			name:      "first success wins",
+			chain:     []*stubResolver{{profile: alice}, {profile: bob}},
+			wantLogin: "alice@example.com",
+			wantCalls: []int{1, 0},
+		},
+		{
+			name:      "skips sources that don't apply",
+			chain:     []*stubResolver{{err: errNotResolved}, {profile: bob}},
+			wantLogin: "bob@example.com",
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:      "errors stop the chain",
+			chain:     []*stubResolver{{err: errLookup}, {profile: bob}},
+			wantErr:   errLookup,
+			wantCalls: []int{1, 0},
+		},
+		{
+			name:      "nothing resolved",
+			chain:     []*stubResolver{{err: errNotResolved}, {err: errNotResolved}},
+			wantErr:   errNotResolved,
+			wantCalls: []int{1, 1},
+		},
+		{
+			name:    "empty chain",
+			wantErr: errNotResolved,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var resolvers []resolver
+			for _, res := range tt.chain {
+				resolvers = append(resolvers, res)
+			}
+			profile, err := resolveIdentity(resolvers, httptest.NewRequest("GET", "/", nil), netip.MustParseAddrPort("100.64.0.1:41641"))
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("resolveIdentity error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && profile.Login != tt.wantLogin {
+				t.Errorf("resolveIdentity login = %q, want %q", profile.Login, tt.wantLogin)
+			}
+			for i, res := range tt.chain {
+				if res.calls != tt.wantCalls[i] {
+					t.Errorf("resolver %d called %d times, want %d", i, res.calls, tt.wantCalls[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseIdentitySources(t *testing.T) {
+	valid := Server{Config: Config{AccessLogFormat: accessLogFormatText, Policy: Policy{DefaultPolicy: defaultPolicyAllow, TaggedNodePolicy: taggedNodeAllowSpecific, TrustedCIDR: "10.42.0.0/16"}, CacheCostMode: cacheCostModeCount, CacheKey: cacheKeyAddress, IdentitySources: "whois", MinHTTPVersion: "1.0"}, CacheBackend: cacheBackendMemory, LogLevel: "info", ListenFamily: "both"}
+	if _, _, err := valid.parseConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for _, sources := range []string{"whois,unknown", "whois,clientcert", "basicauth,whois"} {
+		invalid := valid
+		invalid.IdentitySources = sources
+		if _, _, err := invalid.parseConfig(); err == nil {
+			t.Errorf("parseConfig accepted identity sources %q", sources)
+		}
+	}
+}
+
+func TestIdentitySourceOrder(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	htpasswd := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(htpasswd, []byte("bob@example.com:"+string(hash)+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Alice's node sends Bob's basic auth credentials, so both sources
+	// resolve and the first one configured wins
+	tests := []struct {
+		sources   string
+		wantLogin string
+	}{
+		{"basicauth,whois", "bob@example.com"},
+		{"whois,basicauth", "alice@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sources, func(t *testing.T) {
+			cfg := testConfig()
+			cfg.BasicAuthFile = htpasswd
+			cfg.IdentitySources = tt.sources
+			h, err := NewAuthHandler(cfg, testWhoIs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := newTestRequest("100.64.0.1:41641")
+			r.SetBasicAuth("bob@example.com", "secret")
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if got := w.Header().Get(HeaderTailscaleUserLogin); got != tt.wantLogin {
+				t.Errorf("%s = %q, want %q", HeaderTailscaleUserLogin, got, tt.wantLogin)
+			}
+		})
+	}
+}
+
+func TestFallbackName(t *testing.T) {
+	tests := []struct {
+		fallback string
+		want     string
+	}{
+		{fallback: "", want: ""},
+		{fallback: "login", want: "alice@example.com"},
+		{fallback: "login-local", want: "alice"},
+	}
+	for _, tt := range tests {
+		if got := fallbackName("alice@example.com", tt.fallback); got != tt.want {
+			t.Errorf("fallbackName(%q) = %q, want %q", tt.fallback, got, tt.want)
+		}
+	}
+}
+
+func TestLoginCacheKeyShared(t *testing.T) {
+	c, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &whoisResolver{cache: c, cacheExpiry: time.Minute, cacheKey: cacheKeyLogin}
+	ctx := context.Background()
+
+	// Both devices of the user share one entry with their details
+	res.store(ctx, "100.64.0.1", &userProfile{Login: "alice@example.com", Name: "Alice", Capabilities: []tailcfg.PeerCapability{"example.com/cap/admin"}})
+	res.store(ctx, "100.64.0.2", &userProfile{Login: "alice@example.com", Name: "Alice Smith"})
+	user, err := c.get(ctx, loginCacheKey("alice@example.com"))
+	if err != nil {
+		t.Fatal("user details not cached under the login")
+	}
+	if user.Name != "Alice Smith" {
+		t.Errorf("login entry name = %q, want the latest", user.Name)
+	}
+	for _, addr := range []string{"100.64.0.1", "100.64.0.2"} {
+		node, err := c.get(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if node.Name != "" {
+			t.Errorf("%s entry has its own name %q", addr, node.Name)
+		}
+		profile, err := res.cached(ctx, addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if profile.Login != "alice@example.com" || profile.Name != "Alice Smith" {
+			t.Errorf("%s = %+v, want the shared user details", addr, profile)
+		}
+	}
+
+	// Capabilities stay with the node
+	if profile, _ := res.cached(ctx, "100.64.0.1"); len(profile.Capabilities) != 1 {
+		t.Errorf("capabilities = %v, want the node's own", profile.Capabilities)
+	}
+	if profile, _ := res.cached(ctx, "100.64.0.2"); len(profile.Capabilities) != 0 {
+		t.Errorf("capabilities = %v, want none", profile.Capabilities)
+	}
+
+	// Without the user entry the node's entry is a miss
+	_ = c.delete(ctx, loginCacheKey("alice@example.com"))
+	if _, err := res.cached(ctx, "100.64.0.1"); err == nil {
+		t.Error("cached without the login entry succeeded")
+	}
+}
+
+// blockingWhoIser answers lookups from testWhoIs once release is closed,
+// counting them.
+type blockingWhoIser struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (b *blockingWhoIser) WhoIs(ctx context.Context, remoteAddr string) (*apitype.WhoIsResponse, error) {
+	b.calls.Add(1)
+	select {
+	case <-b.release:
+		return testWhoIs.WhoIs(ctx, remoteAddr)
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestWhoIsCoalesced(t *testing.T) {
+	c, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	whois := &blockingWhoIser{release: make(chan struct{})}
+	res := &whoisResolver{client: whois, cache: c, cacheExpiry: time.Minute}
+	addr := netip.MustParseAddrPort("100.64.0.1:41641")
+
+	// The first caller goes away while the lookup is in flight; the others
+	// still get its result
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error)
+	go func() {
+		_, err := res.resolve(httptest.NewRequest("GET", "/", nil).WithContext(ctx), addr)
+		first <- err
+	}()
+	for whois.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for range n {
+		wg.Go(func() {
+			profile, err := res.resolve(httptest.NewRequest("GET", "/", nil), addr)
+			if err == nil && profile.Login != "alice@example.com" {
+				err = fmt.Errorf("login = %q, want alice@example.com", profile.Login)
+			}
+			errs <- err
+		})
+	}
+	cancel()
+	if err := <-first; !errors.Is(err, context.Canceled) {
+		t.Errorf("canceled caller got %v, want %v", err, context.Canceled)
+	}
+	close(whois.release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := whois.calls.Load(); got != 1 {
+		t.Errorf("%d WhoIs lookups for %d concurrent requests, want 1", got, n+1)
+	}
+}
+
+// fakeStatus reports a peer for each address, assigned to the given node.
+type fakeStatus map[netip.Addr]tailcfg.StableNodeID
+
+func (f fakeStatus) Status(context.Context) (*ipnstate.Status, error) {
+	st := &ipnstate.Status{Peer: make(map[key.NodePublic]*ipnstate.PeerStatus)}
+	for addr, id := range f {
+		st.Peer[key.NewNode().Public()] = &ipnstate.PeerStatus{ID: id, TailscaleIPs: []netip.Addr{addr}}
+	}
+	return st, nil
+}
+
+func TestWhoIsReassigned(t *testing.T) {
+	c, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := netip.MustParseAddrPort("100.64.0.1:41641")
+	whois := fakeWhoIser{"100.64.0.1": testWhoIs["100.64.0.1"]}
+	status := fakeStatus{addr.Addr(): "n1"}
+	peers := &peerIndex{client: status}
+	res := &whoisResolver{client: whois, cache: c, peers: peers, cacheExpiry: time.Minute}
+	resolve := func() *userProfile {
+		t.Helper()
+		profile, err := res.resolve(httptest.NewRequest("GET", "/", nil), addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.client.Wait()
+		return profile
+	}
+	if got := resolve(); got.Login != "alice@example.com" {
+		t.Fatalf("Login = %q, want alice@example.com", got.Login)
+	}
+
+	// The address moves to another user's node. The cached profile is
+	// served while the peer index still has the old node.
+	whois["100.64.0.1"] = &apitype.WhoIsResponse{
+		Node:        &tailcfg.Node{StableID: "n3"},
+		UserProfile: &tailcfg.UserProfile{LoginName: "bob@example.com", DisplayName: "Bob"},
+	}
+	if got := resolve(); got.Login != "alice@example.com" {
+		t.Errorf("Login = %q before the peer index refresh, want the cached alice@example.com", got.Login)
+	}
+
+	// Once the index sees the new node, the profile is resolved again
+	status[addr.Addr()] = "n3"
+	peers.updated = time.Time{}
+	if got := resolve(); got.Login != "bob@example.com" || got.NodeID != "n3" {
+		t.Errorf("profile = %+v after reassignment, want bob@example.com on n3", got)
+	}
+	if cached, err := c.get(context.Background(), "100.64.0.1"); err != nil || cached.Login != "bob@example.com" {
+		t.Errorf("cached profile = %+v, %v, want bob@example.com", cached, err)
+	}
+}
+
+func TestTokenResolver(t *testing.T) {
+	res := &tokenResolver{
+		token:          "bypass",
+		login:          "machine",
+		queryToken:     "scoped",
+		queryHosts:     []string{"events.example.com"},
+		trustedProxies: []netip.Prefix{netip.MustParsePrefix("192.0.2.0/24")},
+	}
+	tests := []struct {
+		name       string
+		host       string
+		uri        string
+		bearer     string
+		remoteAddr string
+		want       bool
+	}{
+		{name: "bearer", host: "app.example.com", uri: "/", bearer: "bypass", want: true},
+		{name: "wrong bearer", host: "app.example.com", uri: "/", bearer: "scoped"},
+		{name: "query token", host: "events.example.com", uri: "/stream?ts_token=scoped", want: true},
+		{name: "query token with port", host: "events.example.com:8443", uri: "/stream?ts_token=scoped", want: true},
+		{name: "query token with escaped key", host: "events.example.com", uri: "/stream?ts%5Ftoken=scoped", want: true},
+		{name: "query token for other host", host: "app.example.com", uri: "/?ts_token=scoped"},
+		{name: "query token host from untrusted peer", host: "events.example.com", uri: "/stream?ts_token=scoped", remoteAddr: "203.0.113.1:41000"},
+		{name: "bypass token in query", host: "events.example.com", uri: "/stream?ts_token=bypass"},
+		{name: "wrong query token", host: "events.example.com", uri: "/stream?ts_token=wrong"},
+		{name: "none", host: "events.example.com", uri: "/stream"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			r.Header.Set("X-Forwarded-Host", tt.host)
+			r.Header.Set("X-Forwarded-Uri", tt.uri)
+			if tt.bearer != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			profile, err := res.resolve(r, netip.AddrPort{})
+			if !tt.want {
+				if !errors.Is(err, errNotResolved) {
+					t.Errorf("resolve = %+v, %v, want not resolved", profile, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.Login != "machine" || !profile.bypass {
+				t.Errorf("resolve = %+v, want the bypass login", profile)
+			}
+		})
+	}
+}
+
+func TestQueryTokenConfig(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.QueryToken = "scoped"
+	cfg.QueryTokenHosts = "events.example.com"
+	if _, err := cfg.parse(); err == nil {
+		t.Error("parse accepted a query token without allowing query tokens")
+	}
+	cfg.AllowQueryToken = true
+	if _, err := cfg.parse(); err == nil {
+		t.Error("parse accepted query tokens without trusted proxies")
+	}
+	cfg.TrustedProxies = "10.0.0.0/8"
+	cfg.QueryTokenHosts = ""
+	if _, err := cfg.parse(); err == nil {
+		t.Error("parse accepted a query token without hosts")
+	}
+	cfg.QueryTokenHosts = "events.example.com"
+	cfg.BypassToken = "scoped"
+	if _, err := cfg.parse(); err == nil {
+		t.Error("parse accepted a query token equal to the bypass token")
+	}
+	cfg.BypassToken = "bypass"
+	if _, err := cfg.parse(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestQueryTokenStripped(t *testing.T) {
+	cfg := testConfig()
+	cfg.AllowQueryToken = true
+	cfg.BypassLogin = "machine"
+	cfg.IdentitySources = "token,whois"
+	cfg.QueryToken = "scoped"
+	cfg.QueryTokenHosts = "events.example.com"
+	cfg.TrustedProxies = "192.0.2.0/24"
+	h, err := NewAuthHandler(cfg, testWhoIs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-Host", "events.example.com")
+	r.Header.Set("X-Forwarded-Uri", "/stream?topic=a&ts_token=scoped")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if got := w.Header().Get(HeaderTailscaleUserLogin); got != "machine" {
+		t.Errorf("%s = %q, want machine", HeaderTailscaleUserLogin, got)
+	}
+	if got, want := w.Header().Get(HeaderTailscaleForwardURI), "/stream?topic=a"; got != want {
+		t.Errorf("%s = %q, want %q", HeaderTailscaleForwardURI, got, want)
+	}
+	// Nothing passed on to the app carries the token
+	for name, values := range w.Header() {
+		for _, v := range values {
+			if strings.Contains(v, "scoped") {
+				t.Errorf("response header %s = %q contains the token", name, v)
+			}
+		}
+	}
+}
+
+func TestRedactQueryToken(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/", "/"},
+		{"/stream?ts_token=scoped", "/stream?ts_token=REDACTED"},
+		{"/stream?a=1&ts_token=scoped&b=2", "/stream?a=1&ts_token=REDACTED&b=2"},
+		{"/stream?my_ts_token=x", "/stream?my_ts_token=x"},
+		{"/stream?ts%5Ftoken=scoped", "/stream?ts_token=REDACTED"},
+	}
+	for _, tt := range tests {
+		if got := redactQueryToken(tt.uri); got != tt.want {
+			t.Errorf("redactQueryToken(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
+
+func TestStripQueryToken(t *testing.T) {
+	tests := []struct {
+		uri  string
+		want string
+	}{
+		{"/", "/"},
+		{"/stream?ts_token=scoped", "/stream"},
+		{"/stream?a=1&ts_token=scoped&b=2", "/stream?a=1&b=2"},
+		{"/stream?ts%5Ftoken=scoped&a=1", "/stream?a=1"},
+		{"/stream?ts_token", "/stream"},
+		{"/stream?my_ts_token=x", "/stream?my_ts_token=x"},
+	}
+	for _, tt := range tests {
+		if got := stripQueryToken(tt.uri); got != tt.want {
+			t.Errorf("stripQueryToken(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
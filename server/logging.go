@@ -0,0 +1,126 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// accessLogFormatText logs access lines through the logger
+	accessLogFormatText = "text"
+	// accessLogFormatCLF logs access lines in the Combined Log Format, with
+	// the login as the authenticated user
+	accessLogFormatCLF = "clf"
+	// accessLogFormatCLFExtended appends the login to Combined Log Format
+	// lines as a separate field, leaving the user field empty
+	accessLogFormatCLFExtended = "clf-extended"
+)
+
+var accessLogFormats = []string{accessLogFormatText, accessLogFormatCLF, accessLogFormatCLFExtended}
+
+// logTimeLayouts maps the named log time formats to their layouts. Any other
+// value is used as a Go time layout.
+var logTimeLayouts = map[string]string{
+	"clf":     "02/Jan/2006:15:04:05 -0700",
+	"rfc3339": time.RFC3339,
+}
+
+// newLogger creates a logger that drops records below level and formats
+// timestamps using format.
+func newLogger(format string, level slog.Level) *slog.Logger {
+	layout, ok := logTimeLayouts[format]
+	if !ok {
+		layout = format
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{
+		Level: level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if a.Key == slog.TimeKey && len(groups) == 0 {
+				return slog.String(slog.TimeKey, a.Value.Time().Format(layout))
+			}
+			return a
+		},
+	}))
+}
+
+// tsnetLogf returns a tsnet log function that logs messages at level.
+func tsnetLogf(level slog.Level) func(format string, args ...any) {
+	return func(format string, args ...any) {
+		msg := strings.TrimSuffix(fmt.Sprintf(format, args...), "\n")
+		slog.Log(context.Background(), level, msg, "source", "tsnet")
+	}
+}
+
+// writeCLF writes an access log line for r in the Combined Log Format:
+//
+//	host - user [time] "request" status bytes "referer" "user-agent"
+//
+// When extended is set the user field is left empty and the login is
+// appended as a quoted field instead.
+func writeCLF(w io.Writer, r *http.Request, status, bytes int, start time.Time, entry *accessLogEntry, extended bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	user := "-"
+	if !extended && entry.Login != "" {
+		// The user field isn't quoted, so it mustn't contain spaces
+		user = strings.ReplaceAll(clfEscape(entry.Login), " ", `\x20`)
+	}
+	size := "-"
+	if bytes > 0 {
+		size = strconv.Itoa(bytes)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s - %s [%s] %s %d %s %s %s",
+		clfEscape(host),
+		user,
+		start.Format(logTimeLayouts["clf"]),
+		clfQuote(r.Method+" "+redactQueryToken(r.URL.RequestURI())+" "+r.Proto),
+		status,
+		size,
+		clfQuote(r.Referer()),
+		clfQuote(r.UserAgent()),
+	)
+	if extended {
+		b.WriteString(" " + clfQuote(entry.Login))
+	}
+	b.WriteString("\n")
+	_, _ = io.WriteString(w, b.String())
+}
+
+// clfQuote quotes s as a log field, using "-" for an empty value.
+func clfQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	return `"` + clfEscape(s) + `"`
+}
+
+// clfEscape escapes quotes, backslashes and bytes that aren't printable
+// ASCII the way Apache does, so a field can't break out of its quotes or
+// the line.
+func clfEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
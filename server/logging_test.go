@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stderrOutput returns what f writes to stderr.
+func stderrOutput(t *testing.T, f func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = prev }()
+	f()
+	_ = w.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestNewLoggerTimeFormat(t *testing.T) {
+	tests := []struct {
+		format string
+		want   string
+	}{
+		{format: "rfc3339", want: `^time=\d{4}-\d{2}-\d{2}T\d{2}:\d{2}:\d{2}(Z|[+-]\d{2}:\d{2}) `},
+		{format: "clf", want: `^time="\d{2}/[A-Z][a-z]{2}/\d{4}:\d{2}:\d{2}:\d{2} [+-]\d{4}" `},
+		{format: "2006-01-02", want: `^time=\d{4}-\d{2}-\d{2} `},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			out := stderrOutput(t, func() {
+				newLogger(tt.format, slog.LevelInfo).Info("started")
+			})
+			if !regexp.MustCompile(tt.want).MatchString(out) {
+				t.Errorf("log line %q doesn't match %s", out, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewLoggerLevel(t *testing.T) {
+	out := stderrOutput(t, func() {
+		logger := newLogger("rfc3339", slog.LevelWarn)
+		logger.Info("request")
+		logger.Warn("lookup failed")
+	})
+	if regexp.MustCompile(`msg=request`).MatchString(out) {
+		t.Errorf("info message logged at warn level: %q", out)
+	}
+	if !regexp.MustCompile(`level=WARN msg="lookup failed"`).MatchString(out) {
+		t.Errorf("warning not logged: %q", out)
+	}
+}
+
+func TestTSNetLogf(t *testing.T) {
+	buf := captureLog(t)
+	newTestTailscaleServer(t, &Server{}).Logf("magicsock: %d active derp conns\n", 1)
+	if buf.Len() != 0 {
+		t.Errorf("backend message logged below debug level: %s", buf)
+	}
+
+	newTestTailscaleServer(t, &Server{TSVerbose: true}).Logf("magicsock: %d active derp conns\n", 1)
+	newTestTailscaleServer(t, &Server{}).UserLogf("To authenticate, visit: %s", "https://login.tailscale.com/a/1")
+	var lines []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, entry)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2: %s", len(lines), buf)
+	}
+	if lines[0]["msg"] != "magicsock: 1 active derp conns" || lines[0]["level"] != "INFO" || lines[0]["source"] != "tsnet" {
+		t.Errorf("verbose backend message = %v, want it at info without the newline", lines[0])
+	}
+	if lines[1]["msg"] != "To authenticate, visit: https://login.tailscale.com/a/1" || lines[1]["level"] != "INFO" {
+		t.Errorf("user message = %v, want it at info", lines[1])
+	}
+}
+
+func TestWriteCLF(t *testing.T) {
+	r := httptest.NewRequest("GET", "/app?q=1", nil)
+	r.RemoteAddr = "192.0.2.1:41641"
+	r.Header.Set("User-Agent", `curl/8.0 "quoted"`)
+	start := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	entry := &accessLogEntry{Login: "alice smith@example.com"}
+
+	tests := []struct {
+		extended bool
+		want     string
+	}{
+		{false, `192.0.2.1 - alice\x20smith@example.com [01/Mar/2024:12:30:00 +0000] "GET /app?q=1 HTTP/1.1" 200 42 "-" "curl/8.0 \"quoted\""` + "\n"},
+		{true, `192.0.2.1 - - [01/Mar/2024:12:30:00 +0000] "GET /app?q=1 HTTP/1.1" 200 42 "-" "curl/8.0 \"quoted\"" "alice smith@example.com"` + "\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		writeCLF(&b, r, http.StatusOK, 42, start, entry, tt.extended)
+		if got := b.String(); got != tt.want {
+			t.Errorf("extended %v:\n got %s\nwant %s", tt.extended, got, tt.want)
+		}
+	}
+}
+
+func TestCLFEscape(t *testing.T) {
+	if got, want := clfEscape("a\"b\\c\nd\x7f"), `a\"b\\c\x0ad\x7f`; got != want {
+		t.Errorf("clfEscape = %s, want %s", got, want)
+	}
+}
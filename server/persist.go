@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	cacheBackendMemory = "memory"
+	cacheBackendFile   = "file"
+
+	// defaultCacheFile is the name of the cache file in the state directory
+	// when no path is given.
+	defaultCacheFile = "profiles.json"
+)
+
+var cacheBackends = []string{cacheBackendMemory, cacheBackendFile, cacheBackendRedis}
+
+// cacheFile returns the path the file cache backend saves profiles to.
+func (p *Server) cacheFile() string {
+	if p.CacheFile != "" {
+		return p.CacheFile
+	}
+	return filepath.Join(p.StateDir, defaultCacheFile)
+}
+
+// load warms the cache with the profiles saved at path. Profiles which have
+// expired past the stale window are skipped; the others keep their original
+// expiry, or none. A missing file leaves the cache empty.
+func (c *cache) load(path string) (int, error) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	var saved map[string]*userProfile
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return 0, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+
+	loaded := 0
+	for key, profile := range saved {
+		if profile == nil {
+			continue
+		}
+		// Profiles without an expiry are kept without a TTL
+		var ttl time.Duration
+		if !profile.Expires.IsZero() {
+			if ttl = time.Until(profile.Expires) + c.staleWindow; ttl <= 0 {
+				continue
+			}
+		}
+		c.store(key, profile, ttl)
+		loaded++
+	}
+	c.client.Wait()
+	return loaded, nil
+}
+
+// save writes the indexed profiles to path, replacing it atomically so a
+// crash mid-write doesn't leave a truncated file behind.
+func (c *cache) save(path string) error {
+	c.mu.Lock()
+	b, err := json.Marshal(c.entries)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write(b); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// saveEvery saves the profiles to path every interval until ctx is done.
+// Failures are logged and retried at the next interval.
+func (c *cache) saveEvery(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.save(path); err != nil {
+				slog.Warn("failed to save cache", "path", path, "error", err)
+			}
+		}
+	}
+}
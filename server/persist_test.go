@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCachePersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defaultCacheFile)
+
+	// Missing files leave the cache empty
+	c, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := c.load(path); err != nil || n != 0 {
+		t.Fatalf("load = %d, %v, want an empty cache", n, err)
+	}
+	_ = c.set(context.Background(), "100.64.0.1", &userProfile{Login: "alice@example.com"}, time.Hour)
+	_ = c.set(context.Background(), "100.64.0.2", &userProfile{Login: "bob@example.com"}, time.Millisecond)
+	_ = c.set(context.Background(), "100.64.0.3", &userProfile{Login: "carol@example.com"}, 0)
+	time.Sleep(10 * time.Millisecond)
+	if err := c.save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only unexpired profiles are loaded, keeping their expiry
+	restarted, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := restarted.load(path); err != nil || n != 2 {
+		t.Fatalf("load = %d, %v, want 2 entries", n, err)
+	}
+	profile, err := restarted.get(context.Background(), "100.64.0.1")
+	if err != nil {
+		t.Fatal("saved profile not loaded")
+	}
+	if profile.Login != "alice@example.com" || time.Until(profile.Expires) < 59*time.Minute {
+		t.Errorf("loaded profile = %+v, want alice expiring in about an hour", profile)
+	}
+	if _, err := restarted.get(context.Background(), "100.64.0.2"); err == nil {
+		t.Error("expired profile loaded")
+	}
+	if profile, err := restarted.get(context.Background(), "100.64.0.3"); err != nil || !profile.Expires.IsZero() {
+		t.Errorf("profile without expiry = %+v, %v, want it loaded without expiry", profile, err)
+	}
+}
+
+func TestCacheLoadCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defaultCacheFile)
+	if err := os.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	c, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.load(path); err == nil {
+		t.Error("load accepted a corrupt file")
+	}
+}
+
+func TestCacheSaveEvery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), defaultCacheFile)
+	c, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.saveEvery(ctx, path, time.Millisecond)
+		close(done)
+	}()
+	_ = c.set(context.Background(), "100.64.0.1", &userProfile{Login: "alice@example.com"}, time.Hour)
+
+	// The process dies without saving on shutdown; the profile is still
+	// there on restart
+	deadline := time.Now().Add(time.Second)
+	for {
+		restarted, err := newCache(100, cacheCostModeCount, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := restarted.load(path); n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("profile not saved periodically")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+}
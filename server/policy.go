@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"tailscale.com/tailcfg"
+)
+
+const (
+	// taggedNodeForbid rejects all tagged nodes.
+	taggedNodeForbid = "forbid"
+	// taggedNodeAllow identifies tagged nodes by their tags, which are
+	// then authorized like logins.
+	taggedNodeAllow = "allow"
+	// taggedNodeAllowSpecific lets tagged nodes with a tag allowed by the
+	// route, or a trusted tag on routes without a policy, through without
+	// identity.
+	taggedNodeAllowSpecific = "allow-specific"
+)
+
+// taggedNodePolicies lists the values the tagged node policy can take.
+var taggedNodePolicies = []string{taggedNodeForbid, taggedNodeAllow, taggedNodeAllowSpecific}
+
+const (
+	// defaultPolicyAllow authorizes identified clients that no rule
+	// restricts.
+	defaultPolicyAllow = "allow"
+	// defaultPolicyDeny only authorizes clients explicitly allowed by a
+	// rule: a trusted tag, a route policy, the login allowlist or the
+	// required capability.
+	defaultPolicyDeny = "deny"
+)
+
+// defaultPolicies lists the values the default policy can take.
+var defaultPolicies = []string{defaultPolicyAllow, defaultPolicyDeny}
+
+// authorize evaluates the rules for an identified client, returning the
+// identity to pass on to the gateway, nil for none, or why it's denied.
+// Clients from trusted or denied CIDR ranges are decided before they're
+// identified; the rules for the others apply in order:
+//
+//  1. Clients with the bypass token are allowed.
+//  2. Tagged nodes are denied, identified by their tags, or allowed
+//     without identity if they carry a tag allowed by the route or, on
+//     routes without a policy, a trusted tag, depending on the tagged node
+//     policy.
+//  3. The route policy of the forwarded host must allow the client. When
+//     there are route policies, requests whose host can't be trusted are
+//     denied.
+//  4. The login must match the login allowlist.
+//  5. The required capability must be granted to the node.
+//  6. Clients no rule explicitly allowed get the default policy.
+func (cfg *config) authorize(r *http.Request, profile *userProfile) (*userProfile, *authError) {
+	if profile.bypass {
+		return profile, nil
+	}
+
+	var policy *routePolicy
+	if len(cfg.routePolicies) > 0 {
+		host, ok := trustedForwardedHost(r, cfg.trustedProxies)
+		if !ok {
+			return nil, authForbiddenPolicy
+		}
+		policy = cfg.routePolicies[host]
+	}
+	if len(profile.Tags) > 0 {
+		switch cfg.taggedNodePolicy {
+		case taggedNodeForbid:
+			return nil, authForbiddenTagged
+		case taggedNodeAllow:
+			tagged := *profile
+			tagged.Login = strings.Join(profile.Tags, ",")
+			tagged.Name = tagged.Login
+			profile = &tagged
+		default:
+			// A route policy overrides the trusted tags, so they don't open
+			// up restricted routes
+			var allowed bool
+			if policy != nil {
+				allowed = policy.allows(profile)
+			} else {
+				allowed = slices.ContainsFunc(profile.Tags, func(tag string) bool {
+					return slices.Contains(cfg.trustedTags, tag)
+				})
+			}
+			if !allowed {
+				return nil, authForbiddenTagged
+			}
+			return nil, nil
+		}
+	}
+
+	explicit := false
+	if policy != nil {
+		if !policy.allows(profile) {
+			return nil, authForbiddenPolicy
+		}
+		explicit = true
+	}
+	if len(cfg.allowedLogins) > 0 {
+		if !slices.ContainsFunc(cfg.allowedLogins, func(re *regexp.Regexp) bool {
+			return re.MatchString(profile.Login)
+		}) {
+			return nil, authForbiddenPolicy
+		}
+		explicit = true
+	}
+	if cfg.requiredCap != "" {
+		if !slices.Contains(profile.Capabilities, tailcfg.PeerCapability(cfg.requiredCap)) {
+			return nil, authForbiddenPolicy
+		}
+		explicit = true
+	}
+
+	if !explicit && cfg.defaultPolicy == defaultPolicyDeny {
+		return nil, authForbiddenPolicy
+	}
+	return profile, nil
+}
+
+// routePolicy restricts which users and tagged nodes may access a host.
+type routePolicy struct {
+	Logins []string
+	Tags   []string
+}
+
+// allows reports whether the profile's login or one of its tags is allowed.
+func (rp *routePolicy) allows(profile *userProfile) bool {
+	if profile.Login != "" && slices.Contains(rp.Logins, profile.Login) {
+		return true
+	}
+	return slices.ContainsFunc(profile.Tags, func(tag string) bool {
+		return slices.Contains(rp.Tags, tag)
+	})
+}
+
+// parseCIDRPolicy parses a CIDR policy of the form
+// allow:10.0.0.0/8,deny:192.168.0.0/16 into the ranges allowed through
+// without identity and those denied outright.
+func parseCIDRPolicy(s string) (allow, deny []netip.Prefix, err error) {
+	for _, rule := range strings.Split(s, ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+		action, cidr, _ := strings.Cut(rule, ":")
+		if action != "allow" && action != "deny" {
+			return nil, nil, fmt.Errorf("CIDR policy rule must start with allow: or deny: %s", rule)
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid CIDR policy rule %s: %v", rule, err)
+		}
+		if action == "allow" {
+			allow = append(allow, prefix)
+		} else {
+			deny = append(deny, prefix)
+		}
+	}
+	return allow, deny, nil
+}
+
+// parseRoutePolicies parses route policies of the form
+// host=login,tag:name,... into a map keyed by host.
+func parseRoutePolicies(specs []string) (map[string]*routePolicy, error) {
+	policies := make(map[string]*routePolicy)
+	for _, spec := range specs {
+		host, rules, ok := strings.Cut(spec, "=")
+		if !ok || host == "" {
+			return nil, fmt.Errorf("invalid route policy: %s", spec)
+		}
+		policy := &routePolicy{}
+		for _, rule := range strings.Split(rules, ",") {
+			rule = strings.TrimSpace(rule)
+			switch {
+			case rule == "":
+			case strings.HasPrefix(rule, "tag:"):
+				policy.Tags = append(policy.Tags, rule)
+			default:
+				policy.Logins = append(policy.Logins, rule)
+			}
+		}
+		policies[normalizeHost(host)] = policy
+	}
+	return policies, nil
+}
+
+// forwardedHost returns the host of the original request being authorized,
+// as reported by the gateway, without its port.
+func forwardedHost(r *http.Request) string {
+	host := r.Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = r.Host
+	}
+	return normalizeHost(host)
+}
+
+// trustedForwardedHost returns the forwarded host when the request comes from
+// one of trustedProxies, and false otherwise, as the client could have chosen
+// it.
+func trustedForwardedHost(r *http.Request, trustedProxies []netip.Prefix) (string, bool) {
+	peer, err := netip.ParseAddrPort(r.RemoteAddr)
+	if err != nil || !containsAddr(trustedProxies, peer.Addr()) {
+		return "", false
+	}
+	return forwardedHost(r), true
+}
+
+// normalizeHost lowercases host and strips its port, if any, so a policy
+// for app.example.com also applies to app.example.com:8443.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(host)
+}
+
+// withPolicyFile returns a copy of the settings with the policy replaced by
+// the JSON policy file at path. Rules missing from the file keep their value
+// in c, so on reload they revert to their flags rather than keeping a value
+// from an earlier policy file. Settings that aren't part of the policy are
+// rejected, as they can't be changed without a restart.
+func (c *Config) withPolicyFile(path string) (*Config, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	settings := *c
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&settings.Policy); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %v", path, err)
+	}
+	return &settings, nil
+}
@@ -0,0 +1,270 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"tailscale.com/tailcfg"
+)
+
+func TestParseCIDRPolicy(t *testing.T) {
+	tests := []struct {
+		policy    string
+		wantAllow []string
+		wantDeny  []string
+		wantErr   bool
+	}{
+		{policy: ""},
+		{policy: "allow:10.0.0.0/8", wantAllow: []string{"10.0.0.0/8"}},
+		{
+			policy:    " allow:10.0.0.0/8, deny:10.1.0.0/16 ,allow:fd7a:115c:a1e0::/48,",
+			wantAllow: []string{"10.0.0.0/8", "fd7a:115c:a1e0::/48"},
+			wantDeny:  []string{"10.1.0.0/16"},
+		},
+		{policy: "10.0.0.0/8", wantErr: true},
+		{policy: "permit:10.0.0.0/8", wantErr: true},
+		{policy: "deny:10.0.0.1", wantErr: true},
+		{policy: "deny:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy, func(t *testing.T) {
+			allow, deny, err := parseCIDRPolicy(tt.policy)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseCIDRPolicy = %v, %v, want an error", allow, deny)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := prefixStrings(allow); !slices.Equal(got, tt.wantAllow) {
+				t.Errorf("allow = %v, want %v", got, tt.wantAllow)
+			}
+			if got := prefixStrings(deny); !slices.Equal(got, tt.wantDeny) {
+				t.Errorf("deny = %v, want %v", got, tt.wantDeny)
+			}
+		})
+	}
+}
+
+func prefixStrings(prefixes []netip.Prefix) []string {
+	var s []string
+	for _, p := range prefixes {
+		s = append(s, p.String())
+	}
+	return s
+}
+
+func TestParseRoutePolicies(t *testing.T) {
+	policies, err := parseRoutePolicies([]string{"App.Example.com:8443=alice@example.com, tag:web"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, ok := policies["app.example.com"]
+	if !ok {
+		t.Fatalf("policies = %v, want one for app.example.com", policies)
+	}
+	if !slices.Equal(policy.Logins, []string{"alice@example.com"}) || !slices.Equal(policy.Tags, []string{"tag:web"}) {
+		t.Errorf("policy = %+v, want alice@example.com and tag:web", policy)
+	}
+
+	if _, err := parseRoutePolicies([]string{"alice@example.com"}); err == nil {
+		t.Error("parseRoutePolicies accepted a policy without a host")
+	}
+}
+
+func TestRoutePolicyAllows(t *testing.T) {
+	policy := &routePolicy{Logins: []string{"alice@example.com"}, Tags: []string{"tag:web"}}
+	tests := []struct {
+		name    string
+		profile *userProfile
+		want    bool
+	}{
+		{name: "allowed login", profile: &userProfile{Login: "alice@example.com"}, want: true},
+		{name: "other login", profile: &userProfile{Login: "bob@example.com"}},
+		{name: "allowed tag", profile: &userProfile{Tags: []string{"tag:ci", "tag:web"}}, want: true},
+		{name: "other tag", profile: &userProfile{Tags: []string{"tag:ci"}}},
+	}
+	for _, tt := range tests {
+		if got := policy.allows(tt.profile); got != tt.want {
+			t.Errorf("%s: allows = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	alice := &userProfile{Login: "alice@example.com", Name: "Alice"}
+	bob := &userProfile{Login: "bob@example.com", Name: "Bob", Capabilities: []tailcfg.PeerCapability{"example.com/cap/app"}}
+	web := &userProfile{Tags: []string{"tag:web"}}
+	ci := &userProfile{Tags: []string{"tag:ci"}}
+	bypass := &userProfile{Login: "machine", Name: "machine", bypass: true}
+
+	tests := []struct {
+		name       string
+		policy     Policy
+		host       string
+		remoteAddr string
+		profile    *userProfile
+		wantLogin  string
+		wantErr    *authError
+	}{
+		{
+			name:      "default allow",
+			policy:    Policy{},
+			profile:   alice,
+			wantLogin: "alice@example.com",
+		},
+		{
+			name:    "default deny",
+			policy:  Policy{DefaultPolicy: defaultPolicyDeny},
+			profile: alice,
+			wantErr: authForbiddenPolicy,
+		},
+		{
+			name:      "bypass before tagged node policy",
+			policy:    Policy{TaggedNodePolicy: taggedNodeForbid, DefaultPolicy: defaultPolicyDeny},
+			profile:   bypass,
+			wantLogin: "machine",
+		},
+		{
+			name:    "tagged node forbidden despite route policy",
+			policy:  Policy{TaggedNodePolicy: taggedNodeForbid, RoutePolicies: []string{"app.example.com=tag:web"}},
+			host:    "app.example.com",
+			profile: web,
+			wantErr: authForbiddenTagged,
+		},
+		{
+			name:    "trusted tag without identity",
+			policy:  Policy{TrustedTags: "tag:web", DefaultPolicy: defaultPolicyDeny},
+			profile: web,
+		},
+		{
+			name:    "trusted tag on restricted route",
+			policy:  Policy{TrustedTags: "tag:web", RoutePolicies: []string{"admin.example.com=bob@example.com"}},
+			host:    "admin.example.com",
+			profile: web,
+			wantErr: authForbiddenTagged,
+		},
+		{
+			name:    "trusted tag on route without policy",
+			policy:  Policy{TrustedTags: "tag:web", RoutePolicies: []string{"admin.example.com=bob@example.com"}},
+			host:    "app.example.com",
+			profile: web,
+		},
+		{
+			name:    "route policy tag without identity",
+			policy:  Policy{RoutePolicies: []string{"app.example.com=tag:web"}},
+			host:    "app.example.com",
+			profile: web,
+		},
+		{
+			name:    "untrusted tag",
+			policy:  Policy{TrustedTags: "tag:web"},
+			profile: ci,
+			wantErr: authForbiddenTagged,
+		},
+		{
+			name:      "tags as login then allowlist",
+			policy:    Policy{TaggedNodePolicy: taggedNodeAllow, AllowedLoginsRegex: []string{`^tag:ci$`}},
+			profile:   ci,
+			wantLogin: "tag:ci",
+		},
+		{
+			name:    "tags as login rejected by allowlist",
+			policy:  Policy{TaggedNodePolicy: taggedNodeAllow, AllowedLoginsRegex: []string{`@example\.com$`}},
+			profile: web,
+			wantErr: authForbiddenPolicy,
+		},
+		{
+			name:    "route policy before allowlist",
+			policy:  Policy{RoutePolicies: []string{"app.example.com=bob@example.com"}, AllowedLoginsRegex: []string{`@example\.com$`}},
+			host:    "app.example.com",
+			profile: alice,
+			wantErr: authForbiddenPolicy,
+		},
+		{
+			name:    "route policy doesn't skip allowlist",
+			policy:  Policy{RoutePolicies: []string{"app.example.com=alice@example.com"}, AllowedLoginsRegex: []string{`^bob@`}},
+			host:    "app.example.com",
+			profile: alice,
+			wantErr: authForbiddenPolicy,
+		},
+		{
+			name:      "route policy of another host",
+			policy:    Policy{RoutePolicies: []string{"admin.example.com=bob@example.com"}},
+			host:      "app.example.com",
+			profile:   alice,
+			wantLogin: "alice@example.com",
+		},
+		{
+			name:       "forged host from untrusted peer",
+			policy:     Policy{RoutePolicies: []string{"admin.example.com=bob@example.com"}},
+			host:       "app.example.com",
+			remoteAddr: "203.0.113.1:41000",
+			profile:    alice,
+			wantErr:    authForbiddenPolicy,
+		},
+		{
+			name:      "route policy with port",
+			policy:    Policy{RoutePolicies: []string{"app.example.com=alice@example.com"}, DefaultPolicy: defaultPolicyDeny},
+			host:      "app.example.com:8443",
+			profile:   alice,
+			wantLogin: "alice@example.com",
+		},
+		{
+			name:    "required capability missing",
+			policy:  Policy{RequiredCap: "example.com/cap/app"},
+			profile: alice,
+			wantErr: authForbiddenPolicy,
+		},
+		{
+			name:      "required capability explicitly allows",
+			policy:    Policy{RequiredCap: "example.com/cap/app", DefaultPolicy: defaultPolicyDeny},
+			profile:   bob,
+			wantLogin: "bob@example.com",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testConfig()
+			if tt.policy.DefaultPolicy != "" {
+				c.DefaultPolicy = tt.policy.DefaultPolicy
+			}
+			if tt.policy.TaggedNodePolicy != "" {
+				c.TaggedNodePolicy = tt.policy.TaggedNodePolicy
+			}
+			c.AllowedLoginsRegex = tt.policy.AllowedLoginsRegex
+			c.RequiredCap = tt.policy.RequiredCap
+			c.RoutePolicies = tt.policy.RoutePolicies
+			c.TrustedTags = tt.policy.TrustedTags
+			c.TrustedProxies = "192.0.2.0/24"
+			cfg, err := c.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest("GET", "/", nil)
+			// Requests come from a trusted gateway unless set otherwise
+			if tt.remoteAddr != "" {
+				r.RemoteAddr = tt.remoteAddr
+			}
+			if tt.host != "" {
+				r.Header.Set("X-Forwarded-Host", tt.host)
+			}
+			profile, denial := cfg.authorize(r, tt.profile)
+			if denial != tt.wantErr {
+				t.Fatalf("authorize denial = %v, want %v", denial, tt.wantErr)
+			}
+			var login string
+			if profile != nil {
+				login = profile.Login
+			}
+			if login != tt.wantLogin {
+				t.Errorf("authorize login = %q, want %q", login, tt.wantLogin)
+			}
+		})
+	}
+}
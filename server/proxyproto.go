@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// proxyProtoHeaderTimeout bounds how long a client has to send the
+	// PROXY protocol header.
+	proxyProtoHeaderTimeout = 10 * time.Second
+	// proxyProtoV1MaxLen is the maximum length of a v1 header line.
+	proxyProtoV1MaxLen = 107
+)
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtoListener accepts connections that start with a PROXY protocol
+// v1 or v2 header, reporting the client address from the header as the
+// connection's remote address.
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &proxyProtoConn{Conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+// proxyProtoConn lazily reads the PROXY protocol header on first use, so a
+// slow client doesn't block the accept loop.
+type proxyProtoConn struct {
+	net.Conn
+	r *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.once.Do(func() {
+		_ = c.Conn.SetReadDeadline(time.Now().Add(proxyProtoHeaderTimeout))
+		c.remoteAddr, c.err = readProxyHeader(c.r)
+		_ = c.Conn.SetReadDeadline(time.Time{})
+		// Keep the connection's address for LOCAL and UNKNOWN headers
+		if c.remoteAddr == nil {
+			c.remoteAddr = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.init()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.r.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.init()
+	return c.remoteAddr
+}
+
+// readProxyHeader reads a PROXY protocol header from r and returns the
+// source address it describes, or nil if it doesn't carry one.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	sig, err := r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+	switch {
+	case bytes.Equal(sig, proxyProtoV2Sig):
+		return readProxyHeaderV2(r)
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		return readProxyHeaderV1(r)
+	default:
+		return nil, errors.New("missing PROXY protocol header")
+	}
+}
+
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+	if len(line) > proxyProtoV1MaxLen || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("malformed PROXY protocol header")
+	}
+
+	// PROXY <TCP4|TCP6|UNKNOWN> <src addr> <dst addr> <src port> <dst port>
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("malformed PROXY protocol header")
+	}
+	addr, err := netip.ParseAddr(fields[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source address: %v", err)
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol source port: %v", err)
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, uint16(port))), nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	// 12 byte signature, version/command, family/protocol, 2 byte length
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+	if hdr[12]>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version: %d", hdr[12]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("failed to read PROXY protocol header: %v", err)
+	}
+
+	// LOCAL connections (e.g. health checks) carry no client address
+	if hdr[12]&0x0f == 0 {
+		return nil, nil
+	}
+	var addr netip.Addr
+	var port uint16
+	switch hdr[13] >> 4 {
+	case 1: // AF_INET: src addr, dst addr, src port, dst port
+		if len(payload) < 12 {
+			return nil, errors.New("malformed PROXY protocol header")
+		}
+		addr = netip.AddrFrom4([4]byte(payload[0:4]))
+		port = binary.BigEndian.Uint16(payload[8:10])
+	case 2: // AF_INET6
+		if len(payload) < 36 {
+			return nil, errors.New("malformed PROXY protocol header")
+		}
+		addr = netip.AddrFrom16([16]byte(payload[0:16]))
+		port = binary.BigEndian.Uint16(payload[32:34])
+	default:
+		return nil, nil
+	}
+	return net.TCPAddrFromAddrPort(netip.AddrPortFrom(addr, port)), nil
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestReadProxyHeaderV1(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{name: "tcp4", header: "PROXY TCP4 100.64.0.1 10.0.0.1 41641 80\r\n", want: "100.64.0.1:41641"},
+		{name: "tcp6", header: "PROXY TCP6 fd7a:115c:a1e0::1 fd7a:115c:a1e0::2 41641 80\r\n", want: "[fd7a:115c:a1e0::1]:41641"},
+		{name: "unknown", header: "PROXY UNKNOWN\r\n"},
+		{name: "missing crlf", header: "PROXY TCP4 100.64.0.1 10.0.0.1 41641 80\n", wantErr: true},
+		{name: "missing fields", header: "PROXY TCP4 100.64.0.1 10.0.0.1 41641\r\n", wantErr: true},
+		{name: "udp", header: "PROXY UDP4 100.64.0.1 10.0.0.1 41641 80\r\n", wantErr: true},
+		{name: "invalid address", header: "PROXY TCP4 100.64.0 10.0.0.1 41641 80\r\n", wantErr: true},
+		{name: "invalid port", header: "PROXY TCP4 100.64.0.1 10.0.0.1 65536 80\r\n", wantErr: true},
+		{name: "too long", header: "PROXY TCP6 " + strings.Repeat("f", 100) + " ::1 1 2\r\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyHeader(bufio.NewReader(strings.NewReader(tt.header + "GET / HTTP/1.1\r\n")))
+			checkProxyAddr(t, addr, err, tt.want, tt.wantErr)
+		})
+	}
+}
+
+// proxyHeaderV2 builds a v2 header with the command, address family and
+// address payload.
+func proxyHeaderV2(command, family byte, payload []byte) []byte {
+	var b bytes.Buffer
+	b.Write(proxyProtoV2Sig)
+	b.WriteByte(0x20 | command)
+	b.WriteByte(family<<4 | 1)
+	_ = binary.Write(&b, binary.BigEndian, uint16(len(payload)))
+	b.Write(payload)
+	return b.Bytes()
+}
+
+// addrPayload is the v2 payload for a connection from src to dst.
+func addrPayload(src, dst netip.AddrPort) []byte {
+	var b bytes.Buffer
+	b.Write(src.Addr().AsSlice())
+	b.Write(dst.Addr().AsSlice())
+	_ = binary.Write(&b, binary.BigEndian, src.Port())
+	_ = binary.Write(&b, binary.BigEndian, dst.Port())
+	return b.Bytes()
+}
+
+func TestReadProxyHeaderV2(t *testing.T) {
+	src4 := netip.MustParseAddrPort("100.64.0.1:41641")
+	dst4 := netip.MustParseAddrPort("10.0.0.1:80")
+	src6 := netip.MustParseAddrPort("[fd7a:115c:a1e0::1]:41641")
+	dst6 := netip.MustParseAddrPort("[fd7a:115c:a1e0::2]:80")
+
+	badVersion := proxyHeaderV2(1, 1, addrPayload(src4, dst4))
+	badVersion[12] = 0x11
+
+	tests := []struct {
+		name    string
+		header  []byte
+		want    string
+		wantErr bool
+	}{
+		{name: "inet", header: proxyHeaderV2(1, 1, addrPayload(src4, dst4)), want: "100.64.0.1:41641"},
+		{name: "inet6", header: proxyHeaderV2(1, 2, addrPayload(src6, dst6)), want: "[fd7a:115c:a1e0::1]:41641"},
+		// Trailing TLVs are skipped with the rest of the payload
+		{name: "inet with tlv", header: proxyHeaderV2(1, 1, append(addrPayload(src4, dst4), 0x04, 0x00, 0x01, 0x00)), want: "100.64.0.1:41641"},
+		{name: "local", header: proxyHeaderV2(0, 0, nil)},
+		{name: "unix", header: proxyHeaderV2(1, 3, make([]byte, 216))},
+		{name: "short inet", header: proxyHeaderV2(1, 1, addrPayload(src4, dst4)[:8]), wantErr: true},
+		{name: "short inet6", header: proxyHeaderV2(1, 2, addrPayload(src6, dst6)[:32]), wantErr: true},
+		{name: "truncated", header: proxyHeaderV2(1, 1, addrPayload(src4, dst4))[:20], wantErr: true},
+		{name: "version", header: badVersion, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Errors are checked without a request after the header, which
+			// would otherwise be read as the rest of a truncated one
+			input := tt.header
+			if !tt.wantErr {
+				input = append(input, "GET / HTTP/1.1\r\n"...)
+			}
+			r := bufio.NewReader(bytes.NewReader(input))
+			addr, err := readProxyHeader(r)
+			checkProxyAddr(t, addr, err, tt.want, tt.wantErr)
+			if err == nil {
+				// The request must follow the header
+				if line, _ := r.ReadString('\n'); line != "GET / HTTP/1.1\r\n" {
+					t.Errorf("read after header = %q, want the request line", line)
+				}
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderMissing(t *testing.T) {
+	if _, err := readProxyHeader(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))); err == nil {
+		t.Error("readProxyHeader accepted a request without a header")
+	}
+}
+
+func checkProxyAddr(t *testing.T, addr net.Addr, err error, want string, wantErr bool) {
+	t.Helper()
+	if wantErr {
+		if err == nil {
+			t.Errorf("readProxyHeader = %v, want an error", addr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want == "" {
+		if addr != nil {
+			t.Errorf("readProxyHeader = %v, want no address", addr)
+		}
+		return
+	}
+	if addr == nil || addr.String() != want {
+		t.Errorf("readProxyHeader = %v, want %s", addr, want)
+	}
+}
@@ -0,0 +1,220 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const cacheBackendRedis = "redis"
+
+// redisKeyPrefix namespaces the keys of cached profiles, so the Redis
+// database can be shared with other applications.
+const redisKeyPrefix = "ts-auth-proxy:profile:"
+
+// redisTimeout bounds connecting to Redis and each command, unless the URL
+// sets its own timeouts, so requests fall back to WhoIs promptly when Redis
+// is unreachable.
+const redisTimeout = 500 * time.Millisecond
+
+// redisScanCount is the number of keys asked for per SCAN when listing or
+// purging cached profiles.
+const redisScanCount = 100
+
+// redisCache is a profileCache shared by every proxy replica using the same
+// Redis database, so a profile resolved by one replica is served by all of
+// them. Errors talking to Redis are returned to the caller, which treats
+// them as a miss and falls back to WhoIs.
+type redisCache struct {
+	client *redis.Client
+	// jitter randomizes each entry's expiry by up to +/- this fraction so
+	// entries set together don't all expire together.
+	jitter float64
+	// staleWindow is how long entries are kept past their expiry so they
+	// can be served while being refreshed in the background.
+	staleWindow time.Duration
+
+	// down is set while Redis is failing, so the outage is logged when it
+	// starts and ends rather than on every request
+	down atomic.Bool
+
+	// Hits, misses and writes of this replica only
+	hits      atomic.Uint64
+	misses    atomic.Uint64
+	sets      atomic.Uint64
+	staleHits atomic.Uint64
+}
+
+// newRedisCache connects to the Redis server at rawURL, e.g.
+// redis://localhost:6379/0. The connection is made lazily, so an unreachable
+// server doesn't prevent startup. Failed commands aren't retried unless the
+// URL sets max_retries, as WhoIs is the fallback.
+func newRedisCache(rawURL string, jitter float64, staleWindow time.Duration) (*redisCache, error) {
+	opts, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %v", err)
+	}
+	query := redisURLQuery(rawURL)
+	if !query.Has("max_retries") {
+		opts.MaxRetries = -1
+	}
+	if !query.Has("dial_timeout") {
+		opts.DialTimeout = redisTimeout
+	}
+	if !query.Has("read_timeout") {
+		opts.ReadTimeout = redisTimeout
+	}
+	if !query.Has("write_timeout") {
+		opts.WriteTimeout = redisTimeout
+	}
+	return &redisCache{
+		client:      redis.NewClient(opts),
+		jitter:      jitter,
+		staleWindow: staleWindow,
+	}, nil
+}
+
+// redisURLQuery returns the options set in the query of rawURL.
+func redisURLQuery(rawURL string) url.Values {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil
+	}
+	return u.Query()
+}
+
+func (c *redisCache) get(ctx context.Context, key string) (*userProfile, error) {
+	b, err := c.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		c.report(ctx, nil)
+		c.misses.Add(1)
+		return nil, fmt.Errorf("addr not found: %s", key)
+	} else if err != nil {
+		c.report(ctx, err)
+		c.misses.Add(1)
+		return nil, err
+	}
+	c.report(ctx, nil)
+	var profile userProfile
+	if err := json.Unmarshal(b, &profile); err != nil {
+		c.misses.Add(1)
+		return nil, fmt.Errorf("failed to decode cached profile %s: %v", key, err)
+	}
+	c.hits.Add(1)
+	profile.key = key
+	return &profile, nil
+}
+
+// set stores the profile for key, expiring it from Redis once the stale
+// window has passed. A zero expiry keeps the profile until it's deleted or
+// purged, or Redis evicts it.
+func (c *redisCache) set(ctx context.Context, key string, profile *userProfile, expiry time.Duration) error {
+	var ttl time.Duration
+	if expiry == 0 {
+		profile.Expires = time.Time{}
+	} else {
+		expiry = jitterExpiry(expiry, c.jitter)
+		profile.Expires = time.Now().Add(expiry)
+		ttl = expiry + c.staleWindow
+	}
+	b, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	if err := c.client.Set(ctx, redisKeyPrefix+key, b, ttl).Err(); err != nil {
+		c.report(ctx, err)
+		return err
+	}
+	c.report(ctx, nil)
+	c.sets.Add(1)
+	return nil
+}
+
+// report tracks whether Redis is reachable from the outcome of a command,
+// logging when it goes down or comes back. Errors from requests that were
+// cancelled say nothing about Redis.
+func (c *redisCache) report(ctx context.Context, err error) {
+	switch {
+	case err == nil:
+		if c.down.CompareAndSwap(true, false) {
+			slog.Info("redis is reachable again")
+		}
+	case ctx.Err() != nil:
+	case c.down.CompareAndSwap(false, true):
+		slog.Warn("redis is unreachable, falling back to WhoIs until it recovers", "error", err)
+	default:
+		slog.Debug("redis command failed", "error", err)
+	}
+}
+
+func (c *redisCache) recordStaleHit() {
+	c.staleHits.Add(1)
+}
+
+func (c *redisCache) delete(ctx context.Context, key string) error {
+	return c.client.Del(ctx, redisKeyPrefix+key).Err()
+}
+
+// purge deletes every cached profile, leaving other keys in the database
+// alone.
+func (c *redisCache) purge(ctx context.Context) error {
+	iter := c.client.Scan(ctx, 0, redisKeyPrefix+"*", redisScanCount).Iterator()
+	for iter.Next(ctx) {
+		if err := c.client.Del(ctx, iter.Val()).Err(); err != nil {
+			return err
+		}
+	}
+	return iter.Err()
+}
+
+// dump lists the cached profiles sorted by key, like the in-memory cache.
+func (c *redisCache) dump(ctx context.Context) ([]cacheEntry, error) {
+	entries := []cacheEntry{}
+	iter := c.client.Scan(ctx, 0, redisKeyPrefix+"*", redisScanCount).Iterator()
+	for iter.Next(ctx) {
+		b, err := c.client.Get(ctx, iter.Val()).Bytes()
+		if errors.Is(err, redis.Nil) {
+			// Expired since it was listed
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var profile userProfile
+		if err := json.Unmarshal(b, &profile); err != nil {
+			continue
+		}
+		entries = append(entries, newCacheEntry(strings.TrimPrefix(iter.Val(), redisKeyPrefix), &profile))
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+	sortCacheEntries(entries)
+	return entries, nil
+}
+
+// stats reports the hits and misses of this replica. The entries are
+// shared, so their number and cost aren't tracked.
+func (c *redisCache) stats() cacheStats {
+	stats := cacheStats{
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		KeysAdded: c.sets.Load(),
+		StaleHits: c.staleHits.Load(),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.Ratio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+func (c *redisCache) close() error {
+	return c.client.Close()
+}
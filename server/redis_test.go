@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func newTestRedisCache(t *testing.T, staleWindow time.Duration) (*redisCache, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	c, err := newRedisCache("redis://"+mr.Addr(), 0, staleWindow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.close() })
+	return c, mr
+}
+
+func TestRedisCacheGetSet(t *testing.T) {
+	c, mr := newTestRedisCache(t, 30*time.Second)
+	ctx := context.Background()
+
+	if _, err := c.get(ctx, "100.64.0.1"); err == nil {
+		t.Fatal("get before set succeeded")
+	}
+	profile := &userProfile{Login: "alice@example.com", Name: "Alice", Tags: []string{"tag:web"}}
+	if err := c.set(ctx, "100.64.0.1", profile, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := mr.TTL(redisKeyPrefix+"100.64.0.1"), time.Minute+30*time.Second; got != want {
+		t.Errorf("TTL = %v, want %v", got, want)
+	}
+
+	got, err := c.get(ctx, "100.64.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Login != profile.Login || got.Name != profile.Name || len(got.Tags) != 1 {
+		t.Errorf("get = %+v, want %+v", got, profile)
+	}
+	if !got.Expires.Equal(profile.Expires) {
+		t.Errorf("Expires = %v, want %v", got.Expires, profile.Expires)
+	}
+
+	stats := c.stats()
+	if stats.Hits != 1 || stats.Misses != 1 || stats.KeysAdded != 1 {
+		t.Errorf("stats = %+v, want 1 hit, 1 miss and 1 key added", stats)
+	}
+}
+
+func TestRedisCacheExpiryJitter(t *testing.T) {
+	const expiry, jitter = time.Hour, 0.2
+	mr := miniredis.RunT(t)
+	c, err := newRedisCache("redis://"+mr.Addr(), jitter, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.close() })
+
+	ttls := make(map[time.Duration]bool)
+	for i := range 50 {
+		addr := netip.AddrFrom4([4]byte{100, 64, 0, byte(i)}).String()
+		if err := c.set(context.Background(), addr, &userProfile{Login: addr}, expiry); err != nil {
+			t.Fatal(err)
+		}
+		ttl := mr.TTL(redisKeyPrefix + addr)
+		if ttl < time.Duration(float64(expiry)*(1-jitter)) || ttl > time.Duration(float64(expiry)*(1+jitter)) {
+			t.Errorf("TTL %v outside %v +/- %v%%", ttl, expiry, jitter*100)
+		}
+		ttls[ttl.Round(time.Second)] = true
+	}
+	if len(ttls) < 10 {
+		t.Errorf("only %d distinct TTLs across 50 entries, want them spread out", len(ttls))
+	}
+}
+
+func TestRedisCacheExpiry(t *testing.T) {
+	c, mr := newTestRedisCache(t, 0)
+	ctx := context.Background()
+
+	if err := c.set(ctx, "100.64.0.1", &userProfile{Login: "alice@example.com"}, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	mr.FastForward(2 * time.Minute)
+	if _, err := c.get(ctx, "100.64.0.1"); err == nil {
+		t.Error("get after expiry succeeded")
+	}
+
+	// A zero expiry keeps the profile without a TTL
+	if err := c.set(ctx, "100.64.0.2", &userProfile{Login: "bob@example.com"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := mr.TTL(redisKeyPrefix + "100.64.0.2"); ttl != 0 {
+		t.Errorf("TTL = %v, want none", ttl)
+	}
+	mr.FastForward(24 * time.Hour)
+	got, err := c.get(ctx, "100.64.0.2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Expires.IsZero() {
+		t.Errorf("Expires = %v, want zero", got.Expires)
+	}
+}
+
+func TestRedisCacheAdmin(t *testing.T) {
+	c, mr := newTestRedisCache(t, 0)
+	ctx := context.Background()
+
+	// Keys of other applications are left alone
+	if err := mr.Set("other", "value"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"100.64.0.2", "100.64.0.1", "100.64.0.3"} {
+		if err := c.set(ctx, key, &userProfile{Login: key}, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.delete(ctx, "100.64.0.3"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.get(ctx, "100.64.0.3"); err == nil {
+		t.Error("get after delete succeeded")
+	}
+	entries, err := c.dump(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Key != "100.64.0.1" || entries[1].Key != "100.64.0.2" {
+		t.Errorf("dump = %+v, want 100.64.0.1 and 100.64.0.2", entries)
+	}
+
+	if err := c.purge(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := c.dump(ctx); len(entries) != 0 {
+		t.Errorf("dump after purge = %+v, want none", entries)
+	}
+	if !mr.Exists("other") {
+		t.Error("purge deleted a key it doesn't own")
+	}
+}
+
+func TestRedisCacheUnreachable(t *testing.T) {
+	c, mr := newTestRedisCache(t, 0)
+	mr.Close()
+
+	// Errors are returned promptly so the caller can fall back to WhoIs
+	start := time.Now()
+	if _, err := c.get(context.Background(), "100.64.0.1"); err == nil {
+		t.Error("get with redis down succeeded")
+	}
+	if err := c.set(context.Background(), "100.64.0.1", &userProfile{Login: "alice@example.com"}, time.Minute); err == nil {
+		t.Error("set with redis down succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 4*redisTimeout {
+		t.Errorf("redis commands took %v with redis down", elapsed)
+	}
+}
+
+func TestRedisCacheFailOpen(t *testing.T) {
+	c, mr := newTestRedisCache(t, 0)
+	mr.Close()
+
+	res := &whoisResolver{client: testWhoIs, cache: c, cacheExpiry: time.Minute}
+	profile, err := res.resolve(httptest.NewRequest("GET", "/", nil), netip.MustParseAddrPort("100.64.0.1:41641"))
+	if err != nil {
+		t.Fatalf("resolve with redis down: %v", err)
+	}
+	if profile.Login != "alice@example.com" {
+		t.Errorf("Login = %q, want alice@example.com", profile.Login)
+	}
+}
+
+func TestRedisCacheOutageLogged(t *testing.T) {
+	c, mr := newTestRedisCache(t, 0)
+	logs := captureLog(t)
+	ctx := context.Background()
+	mr.Close()
+
+	// The outage is logged once, however many commands fail
+	_, _ = c.get(ctx, "100.64.0.1")
+	_, _ = c.get(ctx, "100.64.0.1")
+	_ = c.set(ctx, "100.64.0.1", &userProfile{Login: "alice@example.com"}, time.Minute)
+	if got := strings.Count(logs.String(), `"level":"WARN"`); got != 1 {
+		t.Errorf("%d warnings while redis is down, want 1:\n%s", got, logs)
+	}
+
+	// And so is the recovery
+	if err := mr.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = c.get(ctx, "100.64.0.1")
+	_, _ = c.get(ctx, "100.64.0.1")
+	if got := strings.Count(logs.String(), "redis is reachable again"); got != 1 {
+		t.Errorf("recovery logged %d times, want once:\n%s", got, logs)
+	}
+}
@@ -2,41 +2,242 @@ package server
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math/rand/v2"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"net/netip"
 	"net/url"
 	"os"
+	"os/signal"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/dgraph-io/ristretto/v2"
+	"github.com/redis/go-redis/v9"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/time/rate"
+	"tailscale.com/client/tailscale/apitype"
+	"tailscale.com/ipn/ipnstate"
+	"tailscale.com/tailcfg"
 	"tailscale.com/tsnet"
 )
 
 const (
 	HeaderTailscaleRemoteAddr = "Tailscale-Remote-Addr"
 	HeaderTailscaleRemotePort = "Tailscale-Remote-Port"
-	HeaderTailscaleUserAvatar = "Tailscale-User-Avatar"
-	HeaderTailscaleUserLogin  = "Tailscale-User-Login"
-	HeaderTailscaleUserName   = "Tailscale-User-Name"
+	// HeaderTailscaleResolvedAddr and HeaderTailscaleResolvedPort echo the
+	// client address used for identity lookups when enabled.
+	HeaderTailscaleResolvedAddr = "Tailscale-Resolved-Addr"
+	HeaderTailscaleResolvedPort = "Tailscale-Resolved-Port"
+	HeaderTailscaleUserAvatar   = "Tailscale-User-Avatar"
+	HeaderTailscaleUserLogin    = "Tailscale-User-Login"
+	HeaderTailscaleUserName     = "Tailscale-User-Name"
+	HeaderTailscaleUserSig      = "Tailscale-User-Signature"
+	HeaderTailscaleWhois        = "Tailscale-Whois"
+	HeaderTailscaleDeviceOS     = "Tailscale-Device-OS"
+	HeaderTailscaleDeviceModel  = "Tailscale-Device-Model"
+	// HeaderTailscaleForwardURI is the URI of the original request with the
+	// query token removed, for the gateway to forward to the app instead.
+	HeaderTailscaleForwardURI = "Tailscale-Forward-Uri"
+	HeaderProxyTimeMs         = "X-Proxy-Time-Ms"
+)
 
-	serverShutdownGracePeriod = 30 * time.Second
+var (
+	errNoRemoteAddr    = errors.New("remote address not provided")
+	errUntrustedClient = errors.New("request not from a trusted proxy")
 )
 
+// WhoIsNode is the subset of the Tailscale node forwarded in WhoIsInfo.
+type WhoIsNode struct {
+	ID   tailcfg.StableNodeID `json:"id"`
+	Name string               `json:"name"`
+	Tags []string             `json:"tags,omitempty"`
+}
+
+// WhoIsInfo is the subset of the Tailscale WhoIs result forwarded, as
+// base64-encoded JSON, in the Tailscale-Whois header.
+type WhoIsInfo struct {
+	Node   WhoIsNode          `json:"node"`
+	CapMap tailcfg.PeerCapMap `json:"cap_map,omitempty"`
+}
+
+func encodeWhoIs(info *apitype.WhoIsResponse) (string, error) {
+	b, err := json.Marshal(WhoIsInfo{
+		Node: WhoIsNode{
+			ID:   info.Node.StableID,
+			Name: info.Node.Name,
+			Tags: info.Node.Tags,
+		},
+		CapMap: info.CapMap,
+	})
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// DecodeWhoIsHeader decodes the value of a Tailscale-Whois header.
+func DecodeWhoIsHeader(v string) (*WhoIsInfo, error) {
+	b, err := base64.StdEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	var info WhoIsInfo
+	if err := json.Unmarshal(b, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
 type userProfile struct {
 	Avatar string
 	Login  string
 	Name   string
+	// NodeID identifies the node the profile was resolved for.
+	NodeID tailcfg.StableNodeID
+	// Tags of the node, only set for tagged nodes which don't identify a
+	// user.
+	Tags []string
+	// Expires is when the cached profile should be refreshed, zero if it
+	// never needs to be.
+	Expires time.Time
+
+	// stale is set on copies of expired profiles served while they are
+	// being refreshed.
+	stale bool
+	// Capabilities granted to the node by the tailnet policy.
+	Capabilities []tailcfg.PeerCapability
+	// DeviceOS and DeviceModel describe the node, only populated when
+	// device headers are enabled.
+	DeviceOS    string
+	DeviceModel string
+	// WhoIs is the encoded Tailscale-Whois header, only populated when
+	// forwarding WhoIs results is enabled.
+	WhoIs string
+
+	// key is the cache key the profile is stored under, and cost its cost
+	// in the cache.
+	key  string
+	cost int64
+	// bypass is set on profiles identified by the bypass token.
+	bypass bool
+}
+
+// expired reports whether the profile should be refreshed.
+func (p *userProfile) expired() bool {
+	return !p.Expires.IsZero() && !time.Now().Before(p.Expires)
+}
+
+type cacheStats struct {
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	Ratio       float64 `json:"ratio"`
+	KeysAdded   uint64  `json:"keys_added"`
+	KeysUpdated uint64  `json:"keys_updated"`
+	KeysEvicted uint64  `json:"keys_evicted"`
+	CostAdded   uint64  `json:"cost_added"`
+	CostEvicted uint64  `json:"cost_evicted"`
+	SetsDropped uint64  `json:"sets_dropped"`
+	StaleHits   uint64  `json:"stale_hits"`
+	MaxCost     int64   `json:"max_cost"`
+	// Entries and Cost are the number and total cost of the entries
+	// currently cached.
+	Entries int   `json:"entries"`
+	Cost    int64 `json:"cost"`
+}
+
+const (
+	cacheCostModeCount = "count"
+	cacheCostModeBytes = "bytes"
+
+	// estimatedProfileSize is the assumed average serialized profile size,
+	// used to size the cache when its cost is measured in bytes.
+	estimatedProfileSize = 256
+)
+
+// profileCache stores resolved profiles by key. Implementations should
+// return ctx.Err() once the context is done rather than block, so a slow
+// backend can't hold a request past its deadline.
+type profileCache interface {
+	get(ctx context.Context, key string) (*userProfile, error)
+	set(ctx context.Context, key string, profile *userProfile, expiry time.Duration) error
+	// recordStaleHit counts a hit on an expired entry within the stale
+	// window.
+	recordStaleHit()
+
+	// delete, purge, dump and stats back the admin endpoints.
+	delete(ctx context.Context, key string) error
+	purge(ctx context.Context) error
+	dump(ctx context.Context) ([]cacheEntry, error)
+	stats() cacheStats
 }
 
+// maxCacheExpiryJitter is the largest fraction by which cache expiries can be
+// randomized.
+const maxCacheExpiryJitter = 0.5
+
+// jitterExpiry randomizes expiry by up to +/- the jitter fraction.
+func jitterExpiry(expiry time.Duration, jitter float64) time.Duration {
+	if jitter <= 0 {
+		return expiry
+	}
+	return time.Duration(float64(expiry) * (1 + jitter*(2*rand.Float64()-1)))
+}
+
+// cache is the in-memory profileCache backed by ristretto.
 type cache struct {
 	client *ristretto.Cache[string, *userProfile]
+	cost   func(profile *userProfile) int64
+	// jitter randomizes each entry's expiry by up to +/- this fraction so
+	// entries set together don't all expire together.
+	jitter float64
+	// staleWindow is how long entries are kept past their expiry so they
+	// can be served while being refreshed in the background.
+	staleWindow time.Duration
+	staleHits   atomic.Uint64
+
+	// entries indexes the cached profiles by key, as ristretto can't be
+	// iterated, so they can be listed and saved to disk. totalCost is the
+	// sum of their costs.
+	mu        sync.Mutex
+	entries   map[string]*userProfile
+	totalCost int64
+
+	// purged holds the counters from before the last purge, as clearing
+	// ristretto resets its metrics. It has its own lock as clearing calls
+	// forget, which takes mu.
+	purgeMu sync.Mutex
+	purged  cacheStats
 }
 
-func (c *cache) get(_ context.Context, addr string) (*userProfile, error) {
+// profileSize returns the size of the serialized profile in bytes.
+func profileSize(profile *userProfile) int64 {
+	b, err := json.Marshal(profile)
+	if err != nil {
+		return estimatedProfileSize
+	}
+	return int64(len(b))
+}
+
+// get returns the cached profile for addr.
+func (c *cache) get(ctx context.Context, addr string) (*userProfile, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	profile, ok := c.client.Get(addr)
 	if !ok {
 		return nil, fmt.Errorf("addr not found: %s", addr)
@@ -44,52 +245,886 @@ func (c *cache) get(_ context.Context, addr string) (*userProfile, error) {
 	return profile, nil
 }
 
-func (c *cache) set(_ context.Context, addr string, profile *userProfile, expiry time.Duration) error {
-	c.client.SetWithTTL(addr, profile, 1, expiry)
+// set stores the profile for addr. Concurrent writes to the same key are
+// last-writer-wins: each write is applied before set returns, so the cached
+// value is always the profile from the most recently completed call.
+//
+// A zero expiry keeps the profile until it's evicted to make room for
+// others, deleted or purged.
+func (c *cache) set(ctx context.Context, addr string, profile *userProfile, expiry time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if expiry == 0 {
+		profile.Expires = time.Time{}
+		c.store(addr, profile, 0)
+		c.client.Wait()
+		return nil
+	}
+	expiry = jitterExpiry(expiry, c.jitter)
+	profile.Expires = time.Now().Add(expiry)
+	c.store(addr, profile, expiry+c.staleWindow)
+	c.client.Wait()
 	return nil
 }
 
-func newCache(maxTokens int64) (*cache, error) {
+// store adds the profile to the cache and its index.
+func (c *cache) store(key string, profile *userProfile, ttl time.Duration) {
+	profile.key = key
+	profile.cost = c.cost(profile)
+	c.mu.Lock()
+	if prev, ok := c.entries[key]; ok {
+		c.totalCost -= prev.cost
+	}
+	c.entries[key] = profile
+	c.totalCost += profile.cost
+	c.mu.Unlock()
+	if !c.client.SetWithTTL(key, profile, profile.cost, ttl) {
+		c.forget(profile)
+	}
+}
+
+// forget removes the profile from the index once it leaves the cache.
+func (c *cache) forget(profile *userProfile) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if profile != nil && c.entries[profile.key] == profile {
+		delete(c.entries, profile.key)
+		c.totalCost -= profile.cost
+	}
+}
+
+func (c *cache) recordStaleHit() {
+	c.staleHits.Add(1)
+}
+
+func (c *cache) delete(_ context.Context, addr string) error {
+	c.client.Del(addr)
+	return nil
+}
+
+// purge removes every entry. The hit, miss and key counters carry on from
+// their values before the purge.
+func (c *cache) purge(context.Context) error {
+	c.purgeMu.Lock()
+	defer c.purgeMu.Unlock()
+	purged := c.counters()
+	c.client.Clear()
+	c.purged = purged
+	return nil
+}
+
+// cacheEntry describes a cached profile in a cache dump.
+type cacheEntry struct {
+	Key       string   `json:"key"`
+	Login     string   `json:"login,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	ExpiresIn *float64 `json:"expires_in"`
+}
+
+// dump lists the cached entries sorted by key. ExpiresIn is the number of
+// seconds until the entry should be refreshed, negative for entries being
+// kept past their expiry for the stale window and null for entries which
+// never expire.
+func (c *cache) dump(context.Context) ([]cacheEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := make([]cacheEntry, 0, len(c.entries))
+	for key, profile := range c.entries {
+		entries = append(entries, newCacheEntry(key, profile))
+	}
+	sortCacheEntries(entries)
+	return entries, nil
+}
+
+func newCacheEntry(key string, profile *userProfile) cacheEntry {
+	entry := cacheEntry{
+		Key:   key,
+		Login: profile.Login,
+		Tags:  profile.Tags,
+	}
+	if !profile.Expires.IsZero() {
+		expiresIn := time.Until(profile.Expires).Seconds()
+		entry.ExpiresIn = &expiresIn
+	}
+	return entry
+}
+
+func sortCacheEntries(entries []cacheEntry) {
+	slices.SortFunc(entries, func(a, b cacheEntry) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+}
+
+func (c *cache) stats() cacheStats {
+	c.purgeMu.Lock()
+	stats := c.counters()
+	c.purgeMu.Unlock()
+	c.mu.Lock()
+	stats.Entries, stats.Cost = len(c.entries), c.totalCost
+	c.mu.Unlock()
+	stats.StaleHits = c.staleHits.Load()
+	stats.MaxCost = c.client.MaxCost()
+	return stats
+}
+
+// counters returns the ristretto metrics added to those from before the
+// last purge. c.purgeMu must be held.
+func (c *cache) counters() cacheStats {
+	m := c.client.Metrics
+	stats := cacheStats{
+		Hits:        c.purged.Hits + m.Hits(),
+		Misses:      c.purged.Misses + m.Misses(),
+		KeysAdded:   c.purged.KeysAdded + m.KeysAdded(),
+		KeysUpdated: c.purged.KeysUpdated + m.KeysUpdated(),
+		KeysEvicted: c.purged.KeysEvicted + m.KeysEvicted(),
+		CostAdded:   c.purged.CostAdded + m.CostAdded(),
+		CostEvicted: c.purged.CostEvicted + m.CostEvicted(),
+		SetsDropped: c.purged.SetsDropped + m.SetsDropped(),
+	}
+	if total := stats.Hits + stats.Misses; total > 0 {
+		stats.Ratio = float64(stats.Hits) / float64(total)
+	}
+	return stats
+}
+
+// cacheEntries returns the number of entries a cache of maxTokens holds
+// when full, estimating it from the profile size when costMode is "bytes".
+func cacheEntries(maxTokens int64, costMode string) int64 {
+	if costMode == cacheCostModeBytes {
+		return max(maxTokens/estimatedProfileSize, 1)
+	}
+	return maxTokens
+}
+
+// newCache creates a cache holding up to maxTokens entries, or maxTokens bytes
+// of serialized profiles when costMode is "bytes".
+func newCache(maxTokens int64, costMode string, jitter float64, staleWindow time.Duration) (*cache, error) {
+	c := &cache{
+		cost:        func(*userProfile) int64 { return 1 },
+		jitter:      jitter,
+		staleWindow: staleWindow,
+		entries:     make(map[string]*userProfile),
+	}
+	maxItems := cacheEntries(maxTokens, costMode)
+	if costMode == cacheCostModeBytes {
+		c.cost = profileSize
+	}
+
 	client, err := ristretto.NewCache(&ristretto.Config[string, *userProfile]{
 		// Authors recommend setting NumCounters to 10x the number of items
 		// we expect to keep in the cache when full
 		// See: https://github.com/dgraph-io/ristretto/blob/65472b1ba6fd5d37f34b3d6f807b47fe3b1f4b6d/cache.go#L97
-		NumCounters: maxTokens * 10,
+		NumCounters: maxItems * 10,
 		MaxCost:     maxTokens,
 		// Authors recommend using `64` as the BufferItems value for good performance.
 		// See: https://github.com/dgraph-io/ristretto/blob/65472b1ba6fd5d37f34b3d6f807b47fe3b1f4b6d/cache.go#L125
 		BufferItems: 64,
+		// Track hits, misses and evictions so they can be exposed on the
+		// metrics endpoint to help size the cache.
+		Metrics: true,
+		// Costs are set explicitly, so don't count ristretto's own overhead
+		IgnoreInternalCost: true,
+		// Drop evicted, expired and replaced entries from the index
+		OnExit: c.forget,
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &cache{client: client}, nil
+	c.client = client
+	return c, nil
+}
+
+// parseTags parses a comma-separated list of node tags.
+func parseTags(s string) ([]string, error) {
+	var tags []string
+	for _, tag := range strings.Split(s, ",") {
+		if tag = strings.TrimSpace(tag); tag == "" {
+			continue
+		}
+		if !strings.HasPrefix(tag, "tag:") || tag == "tag:" {
+			return nil, fmt.Errorf("tag must be of the form tag:name: %s", tag)
+		}
+		tags = append(tags, tag)
+	}
+	return tags, nil
+}
+
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, cidr := range strings.Split(s, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
 }
 
-func gracefulShutdown(ctx context.Context, svr *http.Server) error {
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr.Unmap()) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr determines the address of the Tailscale client a request is being
+// authenticated for. The Tailscale-Remote-* headers take precedence; when they
+// are missing, the last hop in X-Forwarded-For that isn't a trusted proxy is
+// used instead, which has no port. If trustedProxies is non-empty, forwarded
+// addresses are only honored when the immediate peer is a trusted proxy.
+// Otherwise, if usePeer is set, the address of the connection is used, which
+// is only meaningful when it comes from a PROXY protocol header.
+func clientAddr(r *http.Request, trustedProxies []netip.Prefix, usePeer bool) (netip.AddrPort, error) {
+	if len(trustedProxies) > 0 {
+		peer, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !containsAddr(trustedProxies, peer.Addr()) {
+			return netip.AddrPort{}, errUntrustedClient
+		}
+	}
+
+	remoteHost := r.Header.Get(HeaderTailscaleRemoteAddr)
+	remotePort := r.Header.Get(HeaderTailscaleRemotePort)
+	if remoteHost != "" && remotePort != "" {
+		return netip.ParseAddrPort(net.JoinHostPort(remoteHost, remotePort))
+	}
+
+	// Only fall back to X-Forwarded-For when it comes from a trusted proxy
+	if len(trustedProxies) == 0 {
+		if usePeer {
+			peer, err := netip.ParseAddrPort(r.RemoteAddr)
+			if err != nil {
+				return netip.AddrPort{}, err
+			}
+			return netip.AddrPortFrom(peer.Addr().Unmap(), peer.Port()), nil
+		}
+		return netip.AddrPort{}, errNoRemoteAddr
+	}
+	hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		addr, err := netip.ParseAddr(hop)
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		if !containsAddr(trustedProxies, addr) {
+			return netip.AddrPortFrom(addr.Unmap(), 0), nil
+		}
+	}
+	return netip.AddrPort{}, errNoRemoteAddr
+}
+
+// SignIdentityHeaders computes the hex-encoded HMAC-SHA256 of the identity
+// headers in h using key. The signed message is the login, name and avatar
+// header values, in that order, each followed by a newline.
+func SignIdentityHeaders(key []byte, h http.Header) string {
+	mac := hmac.New(sha256.New, key)
+	for _, name := range []string{HeaderTailscaleUserLogin, HeaderTailscaleUserName, HeaderTailscaleUserAvatar} {
+		mac.Write([]byte(h.Get(name)))
+		mac.Write([]byte("\n"))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyIdentityHeaders reports whether the Tailscale-User-Signature header
+// in h is a valid signature of the identity headers for key.
+func VerifyIdentityHeaders(key []byte, h http.Header) bool {
+	sig, err := hex.DecodeString(h.Get(HeaderTailscaleUserSig))
+	if err != nil {
+		return false
+	}
+	expected, _ := hex.DecodeString(SignIdentityHeaders(key, h))
+	return hmac.Equal(sig, expected)
+}
+
+// rateLimiter hands out a token bucket per user login.
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+	// idle is at least as long as a bucket takes to refill. A bucket left
+	// unused for longer is full, so it's dropped to keep the map from
+	// growing with every login seen.
+	idle time.Duration
+
+	mu       sync.Mutex
+	limiters map[string]*rateBucket
+	swept    time.Time
+}
+
+type rateBucket struct {
+	lim  *rate.Limiter
+	seen time.Time
+}
+
+// allow reports whether a request for login is allowed right now, and if not,
+// how long the caller should wait before retrying.
+func (l *rateLimiter) allow(login string) (bool, time.Duration) {
+	return l.allowAt(login, time.Now())
+}
+
+func (l *rateLimiter) allowAt(login string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	if now.Sub(l.swept) >= l.idle {
+		for key, b := range l.limiters {
+			if now.Sub(b.seen) >= l.idle {
+				delete(l.limiters, key)
+			}
+		}
+		l.swept = now
+	}
+	b, ok := l.limiters[login]
+	if !ok {
+		b = &rateBucket{lim: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[login] = b
+	}
+	b.seen = now
+	l.mu.Unlock()
+
+	res := b.lim.ReserveN(now, 1)
+	if delay := res.DelayFrom(now); delay > 0 {
+		res.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+func newRateLimiter(limit float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		limit:    rate.Limit(limit),
+		burst:    burst,
+		idle:     max(time.Duration(float64(burst)/limit*float64(time.Second)), time.Minute),
+		limiters: make(map[string]*rateBucket),
+	}
+}
+
+// denialCache remembers recent denials so repeated requests can be rejected
+// without re-running the authorization checks.
+type denialCache struct {
+	client *ristretto.Cache[string, *authError]
+}
+
+func (c *denialCache) get(key string) (*authError, bool) {
+	return c.client.Get(key)
+}
+
+func (c *denialCache) purge() {
+	c.client.Clear()
+}
+
+func (c *denialCache) set(key string, denial *authError, expiry time.Duration) {
+	c.client.SetWithTTL(key, denial, 1, expiry)
+}
+
+// newDenialCache creates a denial cache holding up to maxItems denials.
+func newDenialCache(maxItems int64) (*denialCache, error) {
+	client, err := ristretto.NewCache(&ristretto.Config[string, *authError]{
+		NumCounters:        maxItems * 10,
+		MaxCost:            maxItems,
+		BufferItems:        64,
+		IgnoreInternalCost: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &denialCache{client: client}, nil
+}
+
+// forwardedURI returns the URI of the original request being authorized, as
+// reported by the gateway.
+func forwardedURI(r *http.Request) string {
+	for _, name := range []string{"X-Forwarded-Uri", "X-Original-Uri"} {
+		if uri := r.Header.Get(name); uri != "" {
+			return uri
+		}
+	}
+	return r.URL.RequestURI()
+}
+
+// forwardedInsecure reports whether the gateway says, in the scheme header,
+// that the original request was made over plain HTTP. The header is only
+// honored from trusted proxies when there are any. Requests without it
+// aren't assumed to be either.
+func forwardedInsecure(r *http.Request, header string, trustedProxies []netip.Prefix) bool {
+	if len(trustedProxies) > 0 {
+		peer, err := netip.ParseAddrPort(r.RemoteAddr)
+		if err != nil || !containsAddr(trustedProxies, peer.Addr()) {
+			return false
+		}
+	}
+	return strings.EqualFold(r.Header.Get(header), "http")
+}
+
+// serve runs svr on ln in g until ctx is cancelled, then shuts it down
+// gracefully. The returned channel is closed once shutdown has completed.
+func serve(ctx context.Context, g *errgroup.Group, svr *http.Server, ln net.Listener, name string, shutdownTimeout time.Duration) <-chan struct{} {
+	// Report connection errors through the leveled logger
+	svr.ErrorLog = slog.NewLogLogger(slog.Default().Handler(), slog.LevelError)
+
+	done := make(chan struct{})
+	g.Go(func() error {
+		if err := svr.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("failed to serve %s: %v", name, err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		defer close(done)
+		if err := gracefulShutdown(ctx, svr, shutdownTimeout); err != nil {
+			return fmt.Errorf("failed to shutdown %s server: %v", name, err)
+		}
+		return nil
+	})
+	return done
+}
+
+// listenNetworks maps the listen families to their network names.
+var listenNetworks = map[string]string{
+	"both": "tcp",
+	"ipv4": "tcp4",
+	"ipv6": "tcp6",
+}
+
+func gracefulShutdown(ctx context.Context, svr *http.Server, timeout time.Duration) error {
 	<-ctx.Done()
-	ctx, cancel := context.WithTimeout(context.Background(), serverShutdownGracePeriod)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
 	defer cancel()
-	return svr.Shutdown(ctx)
+	if err := svr.Shutdown(ctx); err != nil {
+		// Connections that didn't drain in time (e.g. hijacked connections)
+		// are forcibly closed so shutdown completes after the deadline
+		_ = svr.Close()
+		return err
+	}
+	return nil
+}
+
+// wrappedResponseWriter records the response status and size and allows
+// adjusting headers right before they are written.
+type wrappedResponseWriter struct {
+	http.ResponseWriter
+	status        int
+	bytes         int
+	onWriteHeader func(h http.Header)
+}
+
+func (w *wrappedResponseWriter) WriteHeader(status int) {
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	if w.onWriteHeader != nil {
+		w.onWriteHeader(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *wrappedResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *wrappedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
 }
 
+// timingHandler reports the time spent handling the request in the
+// X-Proxy-Time-Ms response header.
+func timingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := &wrappedResponseWriter{
+			ResponseWriter: w,
+			onWriteHeader: func(h http.Header) {
+				ms := float64(time.Since(start)) / float64(time.Millisecond)
+				h.Set(HeaderProxyTimeMs, strconv.FormatFloat(ms, 'f', 3, 64))
+			},
+		}
+		next.ServeHTTP(ww, r)
+		// Handlers that don't write anything still need the header
+		if ww.status == 0 {
+			ww.WriteHeader(http.StatusOK)
+		}
+	})
+}
+
+// concurrencyLimitHandler rejects requests with 503 while limit requests are
+// already being handled, rather than queueing them.
+func concurrencyLimitHandler(next http.Handler, limit int) http.Handler {
+	sem := make(chan struct{}, limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// accessLogEntry holds request details discovered by the handler that are
+// included in the access log.
+type accessLogEntry struct {
+	// CacheStatus is hit, stale, miss or negative (served from the denial
+	// cache).
+	CacheStatus string
+	// Login is the login of the identity passed on to the gateway
+	Login       string
+	TrustedCIDR netip.Prefix
+}
+
+type accessLogKey struct{}
+
+// logEntryFromContext returns the access log entry for the request, or a
+// throwaway entry when access logging isn't enabled.
+func logEntryFromContext(ctx context.Context) *accessLogEntry {
+	if entry, ok := ctx.Value(accessLogKey{}).(*accessLogEntry); ok {
+		return entry
+	}
+	return &accessLogEntry{}
+}
+
+// accessLogHandler logs a line in format for every request once it has
+// been handled.
+func accessLogHandler(next http.Handler, format string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		entry := &accessLogEntry{}
+		ww := &wrappedResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), accessLogKey{}, entry)))
+		if ww.status == 0 {
+			ww.status = http.StatusOK
+		}
+
+		if format == accessLogFormatCLF || format == accessLogFormatCLFExtended {
+			writeCLF(os.Stderr, r, ww.status, ww.bytes, start, entry, format == accessLogFormatCLFExtended)
+			return
+		}
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.String("remote_addr", r.RemoteAddr),
+			slog.Int("status", ww.status),
+			slog.Duration("duration", time.Since(start)),
+		}
+		if entry.Login != "" {
+			attrs = append(attrs, slog.String("login", entry.Login))
+		}
+		if entry.CacheStatus != "" {
+			attrs = append(attrs, slog.String("cache_status", entry.CacheStatus))
+		}
+		if entry.TrustedCIDR.IsValid() {
+			attrs = append(attrs, slog.String("trusted_cidr", entry.TrustedCIDR.String()))
+		}
+		slog.LogAttrs(r.Context(), slog.LevelInfo, "request", attrs...)
+	})
+}
+
+// invalidHeader returns the name of the first header whose value contains
+// control characters such as CR, LF or NUL.
+func invalidHeader(h http.Header) (string, bool) {
+	for name, values := range h {
+		for _, v := range values {
+			if strings.ContainsFunc(v, func(r rune) bool {
+				return (r < 0x20 && r != '\t') || r == 0x7f
+			}) {
+				return name, true
+			}
+		}
+	}
+	return "", false
+}
+
+// headerValidationHandler rejects requests with header splitting attempts
+// before they are processed.
+func headerValidationHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if name, ok := invalidHeader(r.Header); ok {
+			// Don't log the value as it's attacker controlled
+			slog.Warn("rejected request with control characters in header", "header", name, "remote_addr", r.RemoteAddr)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loginHintPage is shown to browsers that couldn't be identified, which
+// usually means the device isn't connected to the tailnet.
+const loginHintPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Tailscale login required</title>
+</head>
+<body>
+<h1>Tailscale login required</h1>
+<p>This site is only available to devices connected to the tailnet.</p>
+<p>Install Tailscale from <a href="https://tailscale.com/download">tailscale.com/download</a>,
+log in with your organization account, and then reload this page.</p>
+</body>
+</html>
+`
+
+// acceptsHTML reports whether the client, typically a browser, accepts an
+// HTML response.
+func acceptsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// acceptsJSON reports whether the client accepts a JSON response.
+func acceptsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// authError describes why a request wasn't authorized. It's written as the
+// response body when JSON errors are enabled.
+type authError struct {
+	status  int
+	Code    string `json:"error"`
+	Message string `json:"message"`
+}
+
+var (
+	authUnauthorized    = &authError{http.StatusUnauthorized, "unauthorized", "the client could not be identified"}
+	authWhoIsTimeout    = &authError{http.StatusUnauthorized, "whois_timeout", "timed out identifying the client"}
+	authForbiddenNoUser = &authError{http.StatusForbidden, "forbidden_no_user", "the node is not owned by a user"}
+	authForbiddenTagged = &authError{http.StatusForbidden, "forbidden_tagged", "tagged nodes are not allowed"}
+	authForbiddenPolicy = &authError{http.StatusForbidden, "forbidden_policy", "access is denied by policy"}
+	authForbiddenCIDR   = &authError{http.StatusForbidden, "forbidden_cidr", "the client address is denied"}
+)
+
+// statusError returns an authError for failures without a more specific
+// code.
+func statusError(status int) *authError {
+	return &authError{status, errorCode(status), http.StatusText(status)}
+}
+
+// identityResponse is the body written when response bodies are enabled.
+// Error is a machine-readable code only set on failure.
+type identityResponse struct {
+	Avatar string `json:"avatar,omitempty"`
+	Login  string `json:"login,omitempty"`
+	Name   string `json:"name,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// errorCode converts a status code into an error code, e.g. 429 into
+// "too_many_requests".
+func errorCode(status int) string {
+	return strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// adminHandler serves metrics, health checks, the effective configuration
+// and cache administration.
+// Readiness fails as soon as shutdown starts so load balancers stop routing
+// new requests while in-flight ones drain, or when check fails if it's set.
+func (p *Server) adminHandler(auth *authHandler, shuttingDown *atomic.Bool, check func(ctx context.Context) error) http.Handler {
+	c, denials := auth.profiles, auth.denials
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /admin/config", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, p.redacted(auth.settings.Load()))
+	})
+	mux.HandleFunc("POST /admin/cache/purge", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.purge(r.Context()); err != nil {
+			slog.Warn("failed to purge cache", "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		if denials != nil {
+			denials.purge()
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /admin/cache/dump", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := c.dump(r.Context())
+		if err != nil {
+			slog.Warn("failed to dump cache", "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, http.StatusOK, entries)
+	})
+	mux.HandleFunc("DELETE /admin/cache/{key}", func(w http.ResponseWriter, r *http.Request) {
+		if err := c.delete(r.Context(), r.PathValue("key")); err != nil {
+			slog.Warn("failed to delete cache entry", "error", err)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if shuttingDown.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if check != nil {
+			if err := check(r.Context()); err != nil {
+				slog.Warn("readiness check failed", "error", err)
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(struct {
+			Cache        cacheStats     `json:"cache"`
+			WhoIsLatency histogramStats `json:"whois_latency"`
+		}{
+			Cache:        c.stats(),
+			WhoIsLatency: auth.whoisLatency.stats(),
+		})
+	})
+	return mux
+}
+
+func pprofHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return mux
+}
+
+// deepHealthcheckTimeout bounds the WhoIs lookup done by deep readiness
+// checks.
+const deepHealthcheckTimeout = 2 * time.Second
+
+// Server runs the forward-auth handler on its own tailnet node.
 type Server struct {
-	CacheExpiry time.Duration
-	CacheSize   int64
-	ControlURL  string
-	Hostname    string
-	StateDir    string
-	TrustedCIDR string
-	Upstream    *url.URL
+	Config
+
+	AdvertiseTags     string        `json:"advertise_tags"`
+	AuthKey           string        `json:"auth_key"`
+	CacheBackend      string        `json:"cache_backend"`
+	CacheFile         string        `json:"cache_file"`
+	CacheSaveInterval time.Duration `json:"cache_save_interval"`
+	ControlURL        string        `json:"control_url"`
+	DeepHealthcheck   bool          `json:"deep_healthcheck"`
+	Ephemeral         bool          `json:"ephemeral"`
+	Hostname          string        `json:"hostname"`
+	IdleTimeout       time.Duration `json:"idle_timeout"`
+	ListenAddr        string        `json:"listen_addr"`
+	ListenFamily      string        `json:"listen_family"`
+	LogLevel          string        `json:"log_level"`
+	LogTimeFormat     string        `json:"log_time_format"`
+	MaxHeaderBytes    int           `json:"max_header_bytes"`
+	MetricsAddr       string        `json:"metrics_addr"`
+	OTelEndpoint      string        `json:"otel_endpoint"`
+	PolicyFile        string        `json:"policy_file"`
+	PprofAddr         string        `json:"pprof_addr"`
+	ReadHeaderTimeout time.Duration `json:"read_header_timeout"`
+	ReadTimeout       time.Duration `json:"read_timeout"`
+	RedisURL          string        `json:"redis_url"`
+	ShutdownTimeout   time.Duration `json:"shutdown_timeout"`
+	StartupTimeout    time.Duration `json:"startup_timeout"`
+	StateDir          string        `json:"state_dir"`
+	TSVerbose         bool          `json:"ts_verbose"`
+	WriteTimeout      time.Duration `json:"write_timeout"`
+	Upstream          *url.URL      `json:"upstream"`
 }
 
-func (p *Server) Run() error {
-	// Parse the trusted CIDR ranges
-	var trustedCIDRs []netip.Prefix
-	for _, cidr := range strings.Split(p.TrustedCIDR, ",") {
-		trustedCIDRs = append(trustedCIDRs, netip.MustParsePrefix(cidr))
+// localhostByDefault binds addr to localhost when it has no host, e.g.
+// :9090.
+func localhostByDefault(addr string) string {
+	if host, port, err := net.SplitHostPort(addr); err == nil && host == "" {
+		return net.JoinHostPort("localhost", port)
+	}
+	return addr
+}
+
+// redacted returns a copy of the settings, with c as the effective handler
+// settings, with secrets redacted. Keep the secrets in sync with the flags
+// left out of generated systemd units.
+func (p *Server) redacted(c *Config) Server {
+	settings := *p
+	settings.Config = *c
+	for _, secret := range []*string{&settings.AuthKey, &settings.BypassToken, &settings.HeaderSigningKey, &settings.QueryToken} {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+	if u, err := url.Parse(settings.RedisURL); err == nil {
+		settings.RedisURL = u.Redacted()
+	}
+	return settings
+}
+
+// parseConfig returns the effective handler settings, with the policy file
+// applied on top of the flags, and their parsed form.
+func (p *Server) parseConfig() (*Config, *config, error) {
+	// Apply the policy file on top of the flags
+	settings := &p.Config
+	if p.PolicyFile != "" {
+		var err error
+		if settings, err = p.Config.withPolicyFile(p.PolicyFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	cfg, err := settings.parse()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Check the cache backend
+	if !slices.Contains(cacheBackends, p.CacheBackend) {
+		return nil, nil, fmt.Errorf("invalid cache backend: %s", p.CacheBackend)
+	}
+	if p.CacheBackend == cacheBackendRedis {
+		if p.RedisURL == "" {
+			return nil, nil, errors.New("redis cache backend requires a redis url")
+		}
+		if _, err := redis.ParseURL(p.RedisURL); err != nil {
+			return nil, nil, fmt.Errorf("invalid redis url: %v", err)
+		}
+		cfg.redisURL = p.RedisURL
+	}
+
+	if p.CacheSaveInterval < 0 {
+		return nil, nil, fmt.Errorf("cache save interval must not be negative: %s", p.CacheSaveInterval)
+	}
+
+	// Parse the log level
+	if err := cfg.logLevel.UnmarshalText([]byte(p.LogLevel)); err != nil {
+		return nil, nil, fmt.Errorf("invalid log level: %s", p.LogLevel)
+	}
+
+	// Determine the network to listen on
+	var ok bool
+	if cfg.network, ok = listenNetworks[p.ListenFamily]; !ok {
+		return nil, nil, fmt.Errorf("invalid listen family: %s", p.ListenFamily)
 	}
 
+	return settings, cfg, nil
+}
+
+func (p *Server) prepareStateDir() error {
 	// Create the state directory if it doesn't exist
 	if err := os.MkdirAll(p.StateDir, 0755); err != nil {
 		return fmt.Errorf("failed to create state directory: %v", err)
@@ -102,16 +1137,134 @@ func (p *Server) Run() error {
 	if fi.Mode().Perm()&0200 == 0 {
 		return fmt.Errorf("state directory is not writable")
 	}
+	return nil
+}
+
+func (p *Server) newTailscaleServer() (*tsnet.Server, error) {
+	// Fall back to the environment so the key doesn't have to be passed on
+	// the command line. The key is a secret and must never be logged.
+	authKey := p.AuthKey
+	if authKey == "" {
+		authKey = os.Getenv("TS_AUTHKEY")
+	}
+	// tsnet's backend logs are verbose, so they're only shown at debug
+	// level unless asked for
+	backendLevel := slog.LevelDebug
+	if p.TSVerbose {
+		backendLevel = slog.LevelInfo
+	}
+	// Tags are usually needed with an auth key, since keys for tagged
+	// nodes must be used with the tags they were created for
+	tags, err := parseTags(p.AdvertiseTags)
+	if err != nil {
+		return nil, fmt.Errorf("invalid advertised tags: %v", err)
+	}
+
+	return &tsnet.Server{
+		Hostname:      p.Hostname,
+		Dir:           p.StateDir,
+		ControlURL:    p.ControlURL,
+		AuthKey:       authKey,
+		AdvertiseTags: tags,
+		// Ephemeral nodes are removed from the tailnet when they go offline
+		Ephemeral: p.Ephemeral,
+		Logf:      tsnetLogf(backendLevel),
+		// Messages meant for the user, like the login URL, are always shown
+		UserLogf: tsnetLogf(slog.LevelInfo),
+	}, nil
+}
+
+// Validate checks the configuration and confirms the node can authenticate
+// to the tailnet, without serving any traffic.
+func (p *Server) Validate(ctx context.Context) error {
+	if _, _, err := p.parseConfig(); err != nil {
+		return err
+	}
+	if err := p.prepareStateDir(); err != nil {
+		return err
+	}
+
+	ts, err := p.newTailscaleServer()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ts.Close()
+	}()
+	return p.waitRunning(ctx, ts)
+}
+
+// tailnetNode is the part of tsnet.Server used to bring the node up.
+type tailnetNode interface {
+	Up(ctx context.Context) (*ipnstate.Status, error)
+}
+
+// waitRunning brings up the tsnet server and waits for it to reach the
+// Running state, giving up after the startup timeout.
+func (p *Server) waitRunning(ctx context.Context, ts tailnetNode) error {
+	if p.StartupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.StartupTimeout)
+		defer cancel()
+	}
+	if _, err := ts.Up(ctx); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return fmt.Errorf("tailscale did not reach running state within %s: %v", p.StartupTimeout, err)
+		}
+		return fmt.Errorf("failed to connect to tailnet: %v", err)
+	}
+	return nil
+}
+
+// newHTTPServer creates an HTTP server for handler with the configured
+// timeouts.
+func (p *Server) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: p.ReadHeaderTimeout,
+		ReadTimeout:       p.ReadTimeout,
+		WriteTimeout:      p.WriteTimeout,
+		IdleTimeout:       p.IdleTimeout,
+		MaxHeaderBytes:    p.MaxHeaderBytes,
+	}
+}
+
+// Run serves requests until ctx is cancelled, at which point the servers are
+// gracefully shut down.
+func (p *Server) Run(ctx context.Context) error {
+	settings, cfg, err := p.parseConfig()
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(newLogger(p.LogTimeFormat, cfg.logLevel))
+	if p.CacheExpiry == 0 {
+		slog.Warn("cache entries never expire, so changes to users and nodes aren't seen until they're purged through the admin API")
+	}
+
+	// Export traces if a collector is configured
+	if p.OTelEndpoint != "" {
+		shutdownTracing, err := setupTracing(ctx, p.OTelEndpoint)
+		if err != nil {
+			return fmt.Errorf("failed to set up tracing: %v", err)
+		}
+		defer shutdownTracing()
+	}
+
+	if err := p.prepareStateDir(); err != nil {
+		return err
+	}
 
 	// Create tsnet server
-	ts := &tsnet.Server{
-		Hostname:   p.Hostname,
-		Dir:        p.StateDir,
-		ControlURL: p.ControlURL,
+	ts, err := p.newTailscaleServer()
+	if err != nil {
+		return err
 	}
 	defer func() {
 		_ = ts.Close()
 	}()
+	if err := p.waitRunning(ctx, ts); err != nil {
+		return err
+	}
 
 	// Create ts local client to fetch user info
 	tsCli, err := ts.LocalClient()
@@ -119,85 +1272,132 @@ func (p *Server) Run() error {
 		return fmt.Errorf("failed to create tailscale client: %v", err)
 	}
 
-	// Initialize the in-memory cache
-	cache, err := newCache(p.CacheSize)
+	// Create the forward-auth handler, resolving identities with the ts
+	// local client
+	auth, err := newAuthHandler(&p.Config, cfg, tsCli)
 	if err != nil {
-		return fmt.Errorf("failed to create cache: %v", err)
+		return err
 	}
+	defer auth.close()
+	auth.settings.Store(settings)
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		// Parse remote address from headers
-		remoteHost := r.Header.Get(HeaderTailscaleRemoteAddr)
-		remotePort := r.Header.Get(HeaderTailscaleRemotePort)
-		if remoteHost == "" || remotePort == "" {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-		remoteAddr, err := netip.ParseAddrPort(net.JoinHostPort(remoteHost, remotePort))
+	// Warm the cache from disk so a restart doesn't cause a burst of WhoIs
+	// lookups. A missing or unreadable file only costs those lookups.
+	if p.CacheBackend == cacheBackendFile {
+		n, err := auth.cache.load(p.cacheFile())
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			return
-		}
-
-		// If the remote address is within the trusted CIDR range, allow access
-		for _, cidr := range trustedCIDRs {
-			if cidr.Contains(remoteAddr.Addr()) {
-				w.WriteHeader(http.StatusOK)
-				return
-			}
+			slog.Warn("failed to load cache", "path", p.cacheFile(), "error", err)
+		} else {
+			slog.Info("loaded cache", "path", p.cacheFile(), "entries", n)
 		}
+	}
 
-		// Get user profile from cache if available
-		var profile *userProfile
-		profile, err = cache.get(r.Context(), remoteHost)
-		// Fallback to tailscale if cache miss
-		if err != nil {
-			// Fetch user info from tailscale
-			info, err := tsCli.WhoIs(r.Context(), remoteAddr.String())
-			if err != nil {
-				w.WriteHeader(http.StatusUnauthorized)
-				return
-			}
+	g, ctx := errgroup.WithContext(ctx)
+	httpHandler := auth.handler()
 
-			// Tagged nodes don't identify a user.
-			if info.Node.IsTagged() {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
+	// Save the cache periodically too, so a crash doesn't lose it
+	if p.CacheBackend == cacheBackendFile && p.CacheSaveInterval > 0 {
+		g.Go(func() error {
+			auth.cache.saveEvery(ctx, p.cacheFile(), p.CacheSaveInterval)
+			return nil
+		})
+	}
 
-			// Cache user profile
-			profile = &userProfile{
-				Avatar: info.UserProfile.ProfilePicURL,
-				Login:  info.UserProfile.LoginName,
-				Name:   info.UserProfile.DisplayName,
-			}
-			_ = cache.set(r.Context(), remoteHost, profile, p.CacheExpiry)
+	// Listen before serving so address errors are reported immediately
+	ln, err := net.Listen(cfg.network, p.ListenAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %v", err)
+	}
+	if p.ProxyProtocol {
+		ln = &proxyProtoListener{Listener: ln}
+	}
+	var metricsLn, pprofLn net.Listener
+	// The admin and profiling endpoints aren't authenticated, so they're
+	// served on localhost unless a host is given
+	if p.MetricsAddr != "" {
+		if metricsLn, err = net.Listen(cfg.network, localhostByDefault(p.MetricsAddr)); err != nil {
+			return fmt.Errorf("failed to listen for metrics: %v", err)
+		}
+	}
+	if p.PprofAddr != "" {
+		if pprofLn, err = net.Listen(cfg.network, localhostByDefault(p.PprofAddr)); err != nil {
+			return fmt.Errorf("failed to listen for pprof: %v", err)
 		}
+	}
 
-		// Set headers
-		h := w.Header()
-		h.Set(HeaderTailscaleUserAvatar, profile.Avatar)
-		h.Set(HeaderTailscaleUserLogin, profile.Login)
-		h.Set(HeaderTailscaleUserName, profile.Name)
-	})
+	// Check that WhoIs works end-to-end for readiness by looking up the
+	// node's own address
+	var ready func(ctx context.Context) error
+	if p.DeepHealthcheck {
+		self, ip6 := ts.TailscaleIPs()
+		if !self.IsValid() {
+			self = ip6
+		}
+		ready = func(ctx context.Context) error {
+			ctx, cancel := context.WithTimeout(ctx, deepHealthcheckTimeout)
+			defer cancel()
+			_, err := tsCli.WhoIs(ctx, self.String())
+			return err
+		}
+	}
 
-	g, ctx := errgroup.WithContext(context.Background())
-	var httpHandler http.Handler = mux
+	// Reload the policy file on SIGHUP
+	if p.PolicyFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		g.Go(func() error {
+			defer signal.Stop(hup)
+			for {
+				select {
+				case <-ctx.Done():
+					return nil
+				case <-hup:
+					if err := auth.reload(p.PolicyFile); err != nil {
+						slog.Error("failed to reload policy file", "path", p.PolicyFile, "error", err)
+						continue
+					}
+					slog.Info("reloaded policy file", "path", p.PolicyFile)
+				}
+			}
+		})
+	}
 
-	svr := http.Server{Handler: httpHandler}
+	// Flag that shutdown has started as soon as we're asked to stop
+	var shuttingDown atomic.Bool
 	g.Go(func() error {
-		if err := svr.ListenAndServe(); err != nil {
-			return fmt.Errorf("failed to serve HTTP: %v", err)
-		}
+		<-ctx.Done()
+		shuttingDown.Store(true)
 		return nil
 	})
-	g.Go(func() error {
-		if err := gracefulShutdown(ctx, &svr); err != nil {
-			return fmt.Errorf("failed to shutdown HTTP server: %v", err)
+
+	drained := serve(ctx, g, p.newHTTPServer(httpHandler), ln, "HTTP", p.ShutdownTimeout)
+
+	// Serve metrics, health checks and admin endpoints on a separate address
+	// so they aren't exposed through the forward-auth endpoint. This keeps
+	// serving until the forward-auth server has drained so readiness
+	// reflects shutdown.
+	if metricsLn != nil {
+		adminCtx, cancelAdmin := context.WithCancel(context.WithoutCancel(ctx))
+		g.Go(func() error {
+			<-drained
+			cancelAdmin()
+			return nil
+		})
+		serve(adminCtx, g, p.newHTTPServer(p.adminHandler(auth, &shuttingDown, ready)), metricsLn, "metrics", p.ShutdownTimeout)
+	}
+
+	if pprofLn != nil {
+		serve(ctx, g, p.newHTTPServer(pprofHandler()), pprofLn, "pprof", p.ShutdownTimeout)
+	}
+
+	err = g.Wait()
+
+	// Save the cache once requests have drained so it's warm on restart
+	if p.CacheBackend == cacheBackendFile {
+		if err := auth.cache.save(p.cacheFile()); err != nil {
+			slog.Warn("failed to save cache", "path", p.cacheFile(), "error", err)
 		}
-		return nil
-	})
+	}
 
-	return g.Wait()
+	return err
 }
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/netip"
+	"text/tabwriter"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+// nodeStatus describes the proxy's own node on the tailnet.
+type nodeStatus struct {
+	BackendState string       `json:"backend_state"`
+	Hostname     string       `json:"hostname"`
+	DNSName      string       `json:"dns_name"`
+	Tailnet      string       `json:"tailnet"`
+	TailscaleIPs []netip.Addr `json:"tailscale_ips"`
+}
+
+func newNodeStatus(st *ipnstate.Status) nodeStatus {
+	ns := nodeStatus{
+		BackendState: st.BackendState,
+		TailscaleIPs: st.TailscaleIPs,
+	}
+	if st.Self != nil {
+		ns.Hostname = st.Self.HostName
+		ns.DNSName = st.Self.DNSName
+	}
+	if st.CurrentTailnet != nil {
+		ns.Tailnet = st.CurrentTailnet.Name
+	}
+	return ns
+}
+
+func writeNodeStatus(w io.Writer, ns nodeStatus, format string) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(ns)
+	case "table":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintf(tw, "Backend state:\t%s\n", ns.BackendState)
+		_, _ = fmt.Fprintf(tw, "Hostname:\t%s\n", ns.Hostname)
+		_, _ = fmt.Fprintf(tw, "DNS name:\t%s\n", ns.DNSName)
+		_, _ = fmt.Fprintf(tw, "Tailnet:\t%s\n", ns.Tailnet)
+		for _, ip := range ns.TailscaleIPs {
+			_, _ = fmt.Fprintf(tw, "Tailscale IP:\t%s\n", ip)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format: %s", format)
+	}
+}
+
+// Status connects to the tailnet using the configured state directory and
+// writes the node's status to w, as "json" or a "table", without serving
+// any traffic.
+func (p *Server) Status(ctx context.Context, w io.Writer, format string) error {
+	if err := p.prepareStateDir(); err != nil {
+		return err
+	}
+
+	ts, err := p.newTailscaleServer()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = ts.Close()
+	}()
+	if err := p.waitRunning(ctx, ts); err != nil {
+		return err
+	}
+
+	tsCli, err := ts.LocalClient()
+	if err != nil {
+		return fmt.Errorf("failed to create tailscale client: %v", err)
+	}
+	st, err := tsCli.StatusWithoutPeers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get tailscale status: %v", err)
+	}
+	return writeNodeStatus(w, newNodeStatus(st), format)
+}
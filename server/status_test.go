@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/json"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"tailscale.com/ipn/ipnstate"
+)
+
+func TestWriteNodeStatus(t *testing.T) {
+	ns := newNodeStatus(&ipnstate.Status{
+		BackendState:   "Running",
+		TailscaleIPs:   []netip.Addr{netip.MustParseAddr("100.64.0.10")},
+		Self:           &ipnstate.PeerStatus{HostName: "auth-server", DNSName: "auth-server.example.ts.net."},
+		CurrentTailnet: &ipnstate.TailnetStatus{Name: "example.com"},
+	})
+
+	var b strings.Builder
+	if err := writeNodeStatus(&b, ns, "json"); err != nil {
+		t.Fatal(err)
+	}
+	var got nodeStatus
+	if err := json.Unmarshal([]byte(b.String()), &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.BackendState != "Running" || got.Hostname != "auth-server" || got.Tailnet != "example.com" || len(got.TailscaleIPs) != 1 {
+		t.Errorf("json status = %+v", got)
+	}
+
+	b.Reset()
+	if err := writeNodeStatus(&b, ns, "table"); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"Backend state:  Running\n", "DNS name:       auth-server.example.ts.net.\n", "Tailscale IP:   100.64.0.10\n"} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("table status doesn't contain %q:\n%s", want, b.String())
+		}
+	}
+
+	if err := writeNodeStatus(&b, ns, "yaml"); err == nil {
+		t.Error("writeNodeStatus accepted an unknown format")
+	}
+}
+
+func TestNewNodeStatusNotLoggedIn(t *testing.T) {
+	// Self and the tailnet are unknown until the node has logged in
+	ns := newNodeStatus(&ipnstate.Status{BackendState: "NeedsLogin"})
+	if ns.BackendState != "NeedsLogin" || ns.Hostname != "" || ns.Tailnet != "" {
+		t.Errorf("status = %+v", ns)
+	}
+}
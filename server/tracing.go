@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation name of the spans recorded by the
+// server.
+const tracerName = "github.com/bxnlabs/ts-auth-proxy/server"
+
+// tracerShutdownTimeout bounds how long buffered spans are flushed for on
+// shutdown.
+const tracerShutdownTimeout = 5 * time.Second
+
+// tracer returns the tracer of the global provider, which records nothing
+// until tracing is set up.
+func tracer() trace.Tracer {
+	return otel.Tracer(tracerName)
+}
+
+// setupTracing exports spans to the OTLP/HTTP collector at endpoint, e.g.
+// http://localhost:4318, and accepts W3C trace context from the gateway.
+// The returned function flushes and stops the exporter.
+func setupTracing(ctx context.Context, endpoint string) (func(), error) {
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "ts-auth-proxy"),
+	))
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+		defer cancel()
+		_ = provider.Shutdown(ctx)
+	}, nil
+}
+
+// tracingHandler records a span for every request, continuing the trace
+// the gateway started if it propagated one.
+func tracingHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer().Start(ctx, "forward-auth",
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("server.address", forwardedHost(r)),
+			),
+		)
+		defer span.End()
+
+		ww := &wrappedResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(ww, r.WithContext(ctx))
+		if ww.status == 0 {
+			ww.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", ww.status))
+		if ww.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(ww.status))
+		}
+	})
+}
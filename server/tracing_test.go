@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	// The profile is cached so the resolver doesn't need a tailnet
+	c, err := newCache(100, cacheCostModeCount, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.set(context.Background(), "100.64.0.1", &userProfile{Login: "alice@example.com"}, time.Minute)
+	c.client.Wait()
+	res := &whoisResolver{cache: c}
+	h := tracingHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := res.resolve(r, netip.MustParseAddrPort("100.64.0.1:41641")); err != nil {
+			t.Error(err)
+		}
+	}))
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+
+	spans := recorder.Ended()
+	if len(spans) != 2 {
+		t.Fatalf("recorded %d spans, want 2", len(spans))
+	}
+	whois, request := spans[0], spans[1]
+	if request.Name() != "forward-auth" || request.SpanKind() != trace.SpanKindServer {
+		t.Errorf("span %q of kind %v, want the forward-auth server span", request.Name(), request.SpanKind())
+	}
+	if got := request.Parent().TraceID().String(); got != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("request span trace = %s, want the gateway's", got)
+	}
+	if !request.Parent().IsRemote() {
+		t.Error("request span doesn't continue the remote span")
+	}
+	if whois.Name() != "whois" || whois.Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Errorf("span %q isn't the WhoIs child of the request span", whois.Name())
+	}
+	if got := spanAttr(whois.Attributes(), "cache.hit"); got != attribute.BoolValue(true) {
+		t.Errorf("cache.hit = %v, want true", got.Emit())
+	}
+	if got := spanAttr(request.Attributes(), "http.response.status_code"); got != attribute.IntValue(http.StatusOK) {
+		t.Errorf("http.response.status_code = %v, want %d", got.Emit(), http.StatusOK)
+	}
+}
+
+func spanAttr(attrs []attribute.KeyValue, key attribute.Key) attribute.Value {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return attr.Value
+		}
+	}
+	return attribute.Value{}
+}
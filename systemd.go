@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/pflag"
+)
+
+// systemdUnit is the template for the unit printed by the systemd command.
+var systemdUnit = template.Must(template.New("unit").Parse(`[Unit]
+Description=Tailscale authentication server
+Documentation=https://github.com/bxnlabs/ts-auth-proxy
+Wants=network-online.target
+After=network-online.target
+
+[Service]
+Type=simple
+ExecStart={{ .ExecStart }}
+# Pass secrets such as the Tailscale auth key (TS_AUTHKEY) and the bypass
+# token (TS_AUTH_PROXY_BYPASS_TOKEN) here rather than on the command line
+EnvironmentFile=-/etc/default/ts-auth-proxy
+Restart=on-failure
+RestartSec=5s
+
+# Hardening
+NoNewPrivileges=true
+PrivateTmp=true
+PrivateDevices=true
+ProtectSystem=strict
+ProtectHome=true
+ProtectKernelTunables=true
+ProtectKernelModules=true
+ProtectControlGroups=true
+RestrictSUIDSGID=true
+ReadWritePaths={{ .StateDir }}
+
+[Install]
+WantedBy=multi-user.target
+`))
+
+// systemdSecretFlags are left out of the generated unit as unit files are
+// usually world-readable, whether they were set by flag or environment
+// variable. They match the settings redacted from /admin/config.
+var systemdSecretFlags = []string{"auth-key", "bypass-token", "header-signing-key", "query-token", "redis-url"}
+
+// writeSystemdUnit writes a systemd unit running exe with the flags that
+// were set on the command line.
+func writeSystemdUnit(w io.Writer, exe string, flags *pflag.FlagSet, stateDir string) error {
+	args := []string{systemdQuote(exe)}
+	flags.Visit(func(f *pflag.Flag) {
+		if slices.Contains(systemdSecretFlags, f.Name) {
+			return
+		}
+		values := []string{f.Value.String()}
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			values = sv.GetSlice()
+		}
+		for _, v := range values {
+			args = append(args, systemdQuote(fmt.Sprintf("--%s=%s", f.Name, v)))
+		}
+	})
+
+	return systemdUnit.Execute(w, struct {
+		ExecStart string
+		StateDir  string
+	}{
+		ExecStart: strings.Join(args, " "),
+		StateDir:  systemdQuote(stateDir),
+	})
+}
+
+// systemdQuote quotes s as a single argument of a systemd command line,
+// escaping specifiers and variable expansion.
+func systemdQuote(s string) string {
+	s = strings.NewReplacer("%", "%%", "$", "$$").Replace(s)
+	if !strings.ContainsAny(s, " \t\n\"'\\;") {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
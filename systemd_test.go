@@ -0,0 +1,68 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestSystemdQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"/usr/bin/ts-auth-proxy", "/usr/bin/ts-auth-proxy"},
+		{"--hostname=auth", "--hostname=auth"},
+		{"--trusted-identity=bot,CI Bot", `"--trusted-identity=bot,CI Bot"`},
+		{`--allowed-logins-regex=^a\.b$`, `"--allowed-logins-regex=^a\\.b$$"`},
+		{"100%", "100%%"},
+		{"$HOME", "$$HOME"},
+		{`say "hi"`, `"say \"hi\""`},
+		{"a;b", `"a;b"`},
+		{"it's", `"it's"`},
+		{"line\nbreak", `"line\nbreak"`},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := systemdQuote(tt.in); got != tt.want {
+			t.Errorf("systemdQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWriteSystemdUnitSecrets(t *testing.T) {
+	flags := pflag.NewFlagSet("test", pflag.ContinueOnError)
+	for _, name := range append([]string{"hostname"}, systemdSecretFlags...) {
+		flags.String(name, "", "")
+	}
+	if err := flags.Parse([]string{"--hostname=auth", "--auth-key=tskey-auth-leaked"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Secrets supplied by environment variable are set on the flags too
+	t.Setenv(envName("bypass-token"), "bypass-leaked")
+	t.Setenv(envName("header-signing-key"), "signing-leaked")
+	t.Setenv(envName("query-token"), "query-leaked")
+	t.Setenv(envName("redis-url"), "redis://:redis-leaked@localhost:6379/0")
+	if err := bindEnv(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	var b strings.Builder
+	if err := writeSystemdUnit(&b, "/usr/bin/ts-auth-proxy", flags, "/var/lib/ts-auth-proxy"); err != nil {
+		t.Fatal(err)
+	}
+	unit := b.String()
+	if !strings.Contains(unit, "ExecStart=/usr/bin/ts-auth-proxy --hostname=auth\n") {
+		t.Errorf("unit doesn't run the proxy with its flags:\n%s", unit)
+	}
+	for _, name := range systemdSecretFlags {
+		if strings.Contains(unit, "--"+name) {
+			t.Errorf("unit contains secret flag --%s:\n%s", name, unit)
+		}
+	}
+	if strings.Contains(unit, "leaked") {
+		t.Errorf("unit contains a secret:\n%s", unit)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build details, which can be set at build time with e.g.
+// -ldflags "-X main.version=v1.2.3". Those left unset are filled in from
+// the build info embedded by the Go toolchain.
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// buildInfo describes the running build.
+type buildInfo struct {
+	Version   string
+	Commit    string
+	Date      string
+	Go        string
+	Tailscale string
+}
+
+func readBuildInfo() buildInfo {
+	info := buildInfo{
+		Version: version,
+		Commit:  commit,
+		Date:    date,
+		Go:      runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" {
+			info.Version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = s.Value
+			case s.Key == "vcs.time" && info.Date == "":
+				info.Date = s.Value
+			}
+		}
+		for _, dep := range bi.Deps {
+			if dep.Path == "tailscale.com" {
+				info.Tailscale = dep.Version
+			}
+		}
+	}
+	if info.Version == "" {
+		info.Version = "(devel)"
+	}
+	return info
+}
+
+// String returns the version followed by the other build details that are
+// known.
+func (info buildInfo) String() string {
+	s := info.Version
+	for _, detail := range []struct{ name, value string }{
+		{"commit", info.Commit},
+		{"built", info.Date},
+		{"go", info.Go},
+		{"tailscale", info.Tailscale},
+	} {
+		if detail.value != "" {
+			s += fmt.Sprintf(" %s=%s", detail.name, detail.value)
+		}
+	}
+	return s
+}
+
+func writeVersion(w io.Writer) error {
+	_, err := fmt.Fprintln(w, readBuildInfo())
+	return err
+}
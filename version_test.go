@@ -0,0 +1,41 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadBuildInfo(t *testing.T) {
+	info := readBuildInfo()
+	if info.Version == "" {
+		t.Error("version is empty, want the module version or (devel)")
+	}
+	if info.Go == "" {
+		t.Error("Go version is empty")
+	}
+
+	// Values set at build time take precedence
+	prevVersion, prevCommit := version, commit
+	t.Cleanup(func() { version, commit = prevVersion, prevCommit })
+	version, commit = "v1.2.3", "abc123"
+	if info := readBuildInfo(); info.Version != "v1.2.3" || info.Commit != "abc123" {
+		t.Errorf("build info = %+v, want the values set at build time", info)
+	}
+}
+
+func TestBuildInfoString(t *testing.T) {
+	info := buildInfo{Version: "v1.2.3", Commit: "abc123", Go: "go1.24.0"}
+	if got, want := info.String(), "v1.2.3 commit=abc123 go=go1.24.0"; got != want {
+		t.Errorf("String = %q, want %q", got, want)
+	}
+}
+
+func TestWriteVersion(t *testing.T) {
+	var b strings.Builder
+	if err := writeVersion(&b); err != nil {
+		t.Fatal(err)
+	}
+	if out := strings.TrimSpace(b.String()); out == "" || strings.Contains(out, "\n") {
+		t.Errorf("version output = %q, want one non-empty line", out)
+	}
+}